@@ -0,0 +1,273 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains the Backend interface implemented by push targets,
+and the registry backends register themselves into (by config `type`).
+
+Each domain's config entry has shared settings (url policies etc.),
+plus backend options, which are collected in ConfigEntry.Options and
+decoded by the backend itself (see ConfigEntry.DecodeOptions), so new
+backends don't need to add fields to ConfigEntry.
+*/
+
+package usher
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Backend is a push target for usher mappings. Mappings passed to
+// backends are code => url, with any push-time rewrites (e.g. UTM
+// parameters) already applied.
+type Backend interface {
+	// Validate checks the backend options are complete and sane
+	Validate() error
+	// Plan returns the changes a Push of mappings would make
+	Plan(mappings map[string]string, opts PushOptions) (*Plan, error)
+	// Push publishes mappings, and returns the changes made
+	Push(mappings map[string]string, opts PushOptions) (*Plan, error)
+	// Pull returns the mappings currently published
+	Pull() (map[string]string, error)
+}
+
+// PushOptions are optional settings for PushWithOptions and PlanWithOptions
+type PushOptions struct {
+	NoPrune bool            // don't delete published codes that have been removed locally
+	Force   bool            // override safety limits e.g. on the number of deletions
+	Resume  bool            // continue an interrupted push, for backends that record progress
+	Context context.Context // cancels the push when done (default context.Background())
+}
+
+// ctx returns opts.Context, or context.Background() if unset
+func (opts PushOptions) ctx() context.Context {
+	if opts.Context != nil {
+		return opts.Context
+	}
+	return context.Background()
+}
+
+// BackendFactory returns a new Backend for db, using the settings
+// and options in config
+type BackendFactory func(db *DB, config *ConfigEntry) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend registers factory as the constructor for backends
+// with config type name. It panics if name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("usher: backend %q already registered", name))
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Action is a change a backend makes for a code
+type Action string
+
+const (
+	ActionCreate    Action = "create"
+	ActionUpdate    Action = "update"
+	ActionDelete    Action = "delete"
+	ActionUnchanged Action = "unchanged"
+)
+
+// Change is a planned backend change for a single code
+type Change struct {
+	Code   string `json:"code"`
+	Action Action `json:"action"`
+	Url    string `json:"url,omitempty"`     // new url, for creates and updates
+	OldUrl string `json:"old_url,omitempty"` // current url, for updates and deletes
+}
+
+// Plan is the set of changes a backend push would make, sorted by code
+type Plan struct {
+	Changes []Change
+}
+
+// Count returns the number of changes in plan with action
+func (plan *Plan) Count(action Action) int {
+	n := 0
+	for _, change := range plan.Changes {
+		if change.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// CodeError is a backend error for a single code
+type CodeError struct {
+	Code string
+	Err  error
+}
+
+func (e CodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Err)
+}
+
+func (e CodeError) Unwrap() error {
+	return e.Err
+}
+
+// PushErrors is the set of per-code errors from a push
+type PushErrors []CodeError
+
+func (errs PushErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("push failed for %d code(s):\n  %s", len(errs), strings.Join(msgs, "\n  "))
+}
+
+// diffMappings returns a plan to change the current mappings to the
+// desired ones. If prune is false, codes not in desired are left alone.
+func diffMappings(current, desired map[string]string, prune bool) *Plan {
+	plan := &Plan{}
+	for code, url := range desired {
+		oldUrl, exists := current[code]
+		switch {
+		case !exists:
+			plan.Changes = append(plan.Changes, Change{Code: code, Action: ActionCreate, Url: url})
+		case oldUrl != url:
+			plan.Changes = append(plan.Changes, Change{Code: code, Action: ActionUpdate, Url: url, OldUrl: oldUrl})
+		default:
+			plan.Changes = append(plan.Changes, Change{Code: code, Action: ActionUnchanged, Url: url})
+		}
+	}
+	if prune {
+		for code, oldUrl := range current {
+			if _, exists := desired[code]; !exists {
+				plan.Changes = append(plan.Changes, Change{Code: code, Action: ActionDelete, OldUrl: oldUrl})
+			}
+		}
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].Code < plan.Changes[j].Code
+	})
+	return plan
+}
+
+// DecodeOptions decodes the backend options in config into v (a pointer
+// to a struct with yaml tags). Unknown options are an error.
+func (config *ConfigEntry) DecodeOptions(v interface{}) error {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name)
+		}
+		known[name] = true
+	}
+	var unknown []string
+	for key := range config.Options {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown %s backend option(s): %s", config.Type, strings.Join(unknown, ", "))
+	}
+
+	data, err := yaml.Marshal(config.Options)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("invalid %s backend options: %w", config.Type, err)
+	}
+	return nil
+}
+
+// Backend returns the configured backend for db.Domain
+func (db *DB) Backend() (Backend, error) {
+	config, err := db.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	return db.backend(config)
+}
+
+// backend is a utility function to return the backend for config
+func (db *DB) backend(config *ConfigEntry) (Backend, error) {
+	switch config.Type {
+	case "":
+		return nil, fmt.Errorf("no 'type' field found for %q in config %q\n",
+			db.Domain, db.ConfigPath)
+	case "unconfigured":
+		return nil, ErrPushTypeUnconfigured
+	}
+
+	backendsMu.RLock()
+	factory, exists := backends[config.Type]
+	backendsMu.RUnlock()
+	if !exists {
+		// Fallback to an external `usher-backend-TYPE` executable
+		factory = lookupExecBackend
+	}
+
+	backend, err := factory(db, config)
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("invalid config backend type %q found for %q: %w",
+			config.Type, db.Domain, ErrPushTypeBad)
+	}
+	err = backend.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// Plan returns the changes Push would make to the configured backend
+func (db *DB) Plan() (*Plan, error) {
+	return db.PlanWithOptions(PushOptions{})
+}
+
+// PlanWithOptions returns the changes PushWithOptions would make to the
+// configured backend, using the settings in opts
+func (db *DB) PlanWithOptions(opts PushOptions) (*Plan, error) {
+	backend, mappings, err := db.preparePush()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Plan(mappings, opts)
+}
+
+// Pull returns the mappings currently published by the configured backend
+func (db *DB) Pull() (map[string]string, error) {
+	backend, err := db.Backend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Pull()
+}
@@ -0,0 +1,313 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for applying database mutations in
+batches, so that many adds, updates and removes can be applied
+atomically with a single read and write of the database.
+*/
+
+package usher
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// timeNow returns the current time (replaceable for testing)
+var timeNow = time.Now
+
+// Tx is a database transaction, used to apply mutations within Batch
+type Tx struct {
+	db       *DB
+	mappings map[string]*Entry
+	policy   *urlPolicy // read on first use, by urlPolicy
+	changed  bool
+}
+
+// BatchOp is a single batch operation, as parsed by ParseBatchOp
+type BatchOp struct {
+	Op      string `json:"op"` // "add", "update", or "rm"
+	Url     string `json:"url,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+	New     bool   `json:"new,omitempty"`
+	Private bool   `json:"private,omitempty"`
+}
+
+// Batch calls fn with a transaction on the current database, and then
+// writes any changes made in a single update. If fn returns an error,
+// all changes are discarded.
+func (db *DB) Batch(fn func(tx *Tx) error) error {
+	mappings, err := db.readDB()
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{db: db, mappings: mappings}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	if !tx.changed {
+		return nil
+	}
+	return db.writeDB(tx.mappings)
+}
+
+// urlPolicy returns the url policy for tx, reading the config and
+// blocklists on first use (so batches that don't need them, like
+// removes, don't pay for them)
+func (tx *Tx) urlPolicy() (*urlPolicy, error) {
+	if tx.policy == nil {
+		policy, err := tx.db.readUrlPolicy()
+		if err != nil {
+			return nil, err
+		}
+		tx.policy = policy
+	}
+	return tx.policy, nil
+}
+
+// Add a mapping for url and code within tx, using the settings in opts.
+// If code is missing, the code of any existing mapping for url with the
+// same visibility will be returned (unless opts.New is set), or else a
+// random code will be generated and returned. Also returns true if no
+// mapping was added because url was already mapped (to code, if given).
+func (tx *Tx) Add(url, code string, opts AddOptions) (string, bool, error) {
+	url, code = uninvert(url, code)
+
+	// Validate and normalise url, and check host policies
+	policy, err := tx.urlPolicy()
+	if err != nil {
+		return code, false, err
+	}
+	url, err = policy.apply(url, opts.Force)
+	if err != nil {
+		return code, false, err
+	}
+
+	if code == "" {
+		// If url is already mapped with the same visibility, return the
+		// existing code unless opts.New
+		if !opts.New {
+			for _, c := range codesForUrl(tx.mappings, url) {
+				if tx.mappings[c].Private == opts.Private {
+					return c, true, nil
+				}
+			}
+		}
+		code = randomCode(tx.mappings)
+
+	} else {
+		// Normalise code to NFC, and check it's sane
+		code = NormaliseCode(code)
+		err = checkCode(code)
+		if err != nil {
+			return code, false, err
+		}
+		if code == indexCode && opts.Private {
+			return code, false, ErrIndexPrivate
+		}
+
+		// Check whether code is already used
+		dbentry, exists := tx.mappings[code]
+		if exists {
+			if dbentry.Url == url {
+				// Trying to re-add the same url is not an error, just a noop
+				return code, true, nil
+			}
+			return code, false, ErrCodeExists
+		}
+	}
+
+	// Record the creation time, unless given (e.g. by imports)
+	created := opts.Created
+	if created.IsZero() {
+		created = timeNow().UTC().Truncate(time.Second)
+	}
+	tx.mappings[code] = &Entry{Code: code, Url: url, Title: opts.Title, Tags: opts.Tags,
+		Created: created, Clicks: opts.Clicks, Private: opts.Private}
+	tx.changed = true
+
+	return code, false, nil
+}
+
+// Update an existing mapping within tx, changing the URL, using the
+// settings in opts
+func (tx *Tx) Update(url, code string, opts UpdateOptions) error {
+	url, code = uninvert(url, code)
+	code = NormaliseCode(code)
+
+	// Validate and normalise url, and check host policies
+	policy, err := tx.urlPolicy()
+	if err != nil {
+		return err
+	}
+	url, err = policy.apply(url, opts.Force)
+	if err != nil {
+		return err
+	}
+
+	// If code is missing, abort
+	dbentry, exists := tx.mappings[code]
+	if !exists {
+		return ErrNotFound
+	}
+
+	// Trying to update to the same url is not an error, just a noop
+	if dbentry.Url == url {
+		return nil
+	}
+
+	dbentry.Url = url
+	tx.changed = true
+
+	return nil
+}
+
+// Set changes the attributes in opts for the mapping with code within tx
+// Returns ErrNotFound if code does not exist
+func (tx *Tx) Set(code string, opts SetOptions) error {
+	code = NormaliseCode(code)
+	dbentry, exists := tx.mappings[code]
+	if !exists {
+		return ErrNotFound
+	}
+
+	entry := *dbentry
+	if opts.Title != nil {
+		entry.Title = *opts.Title
+	}
+	if opts.Tags != nil {
+		entry.Tags = opts.Tags
+		if len(entry.Tags) == 0 {
+			entry.Tags = nil
+		}
+	}
+	if opts.Private != nil {
+		if code == indexCode && *opts.Private {
+			return ErrIndexPrivate
+		}
+		entry.Private = *opts.Private
+	}
+
+	if reflect.DeepEqual(entry, *dbentry) {
+		return nil
+	}
+	tx.put(entry)
+
+	return nil
+}
+
+// Remove the mapping with code within tx
+// Returns ErrNotFound if code does not exist
+func (tx *Tx) Remove(code string) error {
+	code = NormaliseCode(code)
+	_, exists := tx.mappings[code]
+	if !exists {
+		return ErrNotFound
+	}
+
+	delete(tx.mappings, code)
+	tx.changed = true
+
+	return nil
+}
+
+// reUrlArg matches url arguments, for detecting inverted url and code
+// parameters
+var reUrlArg = regexp.MustCompile(`^https?://`)
+
+// uninvert returns url and code, swapped if they look to have been
+// given in the wrong order
+func uninvert(url, code string) (string, string) {
+	if code != "" && !reUrlArg.MatchString(url) && reUrlArg.MatchString(code) {
+		return code, url
+	}
+	return url, code
+}
+
+// put is a utility function to add or replace entry within tx
+func (tx *Tx) put(entry Entry) {
+	tx.mappings[entry.Code] = &entry
+	tx.changed = true
+}
+
+// Apply applies op within tx, returning the code affected
+func (tx *Tx) Apply(op *BatchOp) (string, error) {
+	switch op.Op {
+	case "add":
+		code, _, err := tx.Add(op.Url, op.Code, AddOptions{Force: op.Force, New: op.New, Private: op.Private})
+		return code, err
+	case "update":
+		if op.Code == "" {
+			return "", fmt.Errorf("update requires a code")
+		}
+		return op.Code, tx.Update(op.Url, op.Code, UpdateOptions{Force: op.Force})
+	case "rm":
+		return op.Code, tx.Remove(op.Code)
+	default:
+		return "", fmt.Errorf("invalid batch op %q", op.Op)
+	}
+}
+
+// ParseBatchOp parses a batch operation from line, which may be either
+// a JSON object (e.g. `{"op":"add","url":"https://example.com","code":"ex"}`)
+// or whitespace-separated fields in usher command form e.g.
+//
+//	add <url> [<code>]
+//	update <url> <code>
+//	rm <code>
+//
+// Blank lines and comments (starting with `#`) return a nil op.
+func ParseBatchOp(line string) (*BatchOp, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	var op BatchOp
+	if strings.HasPrefix(line, "{") {
+		err := json.Unmarshal([]byte(line), &op)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json batch op: %s", err)
+		}
+	} else {
+		fields := strings.Fields(line)
+		op.Op = fields[0]
+		args := fields[1:]
+		switch {
+		case op.Op == "add" && (len(args) == 1 || len(args) == 2):
+			op.Url = args[0]
+			if len(args) == 2 {
+				op.Code = args[1]
+			}
+		case op.Op == "update" && len(args) == 2:
+			op.Url, op.Code = args[0], args[1]
+		case op.Op == "rm" && len(args) == 1:
+			op.Code = args[0]
+		default:
+			return nil, fmt.Errorf("invalid batch op %q", line)
+		}
+	}
+
+	switch op.Op {
+	case "add", "update":
+		if op.Url == "" {
+			return nil, fmt.Errorf("batch op %q missing url", op.Op)
+		}
+	case "rm":
+		if op.Code == "" {
+			return nil, fmt.Errorf("batch op %q missing code", op.Op)
+		}
+	default:
+		return nil, fmt.Errorf("invalid batch op %q", op.Op)
+	}
+
+	return &op, nil
+}
@@ -0,0 +1,301 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for checking url destination hosts
+against local blocklists of known malicious or phishing domains.
+
+Blocklists are files in the `blocklists` directory in the usher
+root, and may use any of the following (per-line) formats:
+- hosts-file format e.g. `0.0.0.0 bad.example.com`
+- plain domains e.g. `bad.example.com`
+- AdGuard/ABP-style rules e.g. `||bad.example.com^`, with `@@||...`
+  exception rules
+Comments (`#` or `!`) and blank lines are ignored. Blocked domains
+also block all their subdomains.
+*/
+
+package usher
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const blocklistDir = "blocklists"
+
+// hostsFileIgnore are hostnames commonly found in hosts files that
+// should never be treated as blocked
+var hostsFileIgnore = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Blocklist is a set of blocked domains loaded from one or more files
+type Blocklist struct {
+	blocked map[string]string // domain => blocklist name
+	allowed map[string]string // exception domain => blocklist name
+}
+
+// AuditResult records a mapping that fails current policy checks
+type AuditResult struct {
+	Code string
+	Url  string
+	Err  error
+}
+
+// newBlocklist returns an empty Blocklist
+func newBlocklist() *Blocklist {
+	return &Blocklist{
+		blocked: make(map[string]string),
+		allowed: make(map[string]string),
+	}
+}
+
+// Len returns the number of blocked domains in b
+func (b *Blocklist) Len() int {
+	return len(b.blocked)
+}
+
+// parse reads blocklist rules from r, recording them against name
+func (b *Blocklist) parse(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		// Strip trailing comments
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		switch {
+		// AdGuard exception rule
+		case strings.HasPrefix(line, "@@"):
+			if domain := adguardDomain(line[2:]); domain != "" {
+				b.allowed[domain] = name
+			}
+
+		// AdGuard block rule
+		case strings.HasPrefix(line, "||"):
+			if domain := adguardDomain(line); domain != "" {
+				b.blocked[domain] = name
+			}
+
+		default:
+			fields := strings.Fields(line)
+			// Hosts file format - ip address followed by one or more hostnames
+			if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+				fields = fields[1:]
+			}
+			for _, field := range fields {
+				domain := normaliseHost(field)
+				if domain == "" || hostsFileIgnore[domain] || net.ParseIP(domain) != nil {
+					continue
+				}
+				b.blocked[domain] = name
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// adguardDomain returns the domain from a basic AdGuard rule like
+// `||example.com^$third-party`, or an empty string if the rule is not
+// a plain domain rule
+func adguardDomain(rule string) string {
+	rule = strings.TrimPrefix(rule, "||")
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		rule = rule[:i]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+	if rule == "" || strings.ContainsAny(rule, "/*^|") {
+		return ""
+	}
+	return normaliseHost(rule)
+}
+
+// Match checks whether host (or any of its parent domains) is blocked,
+// returning the blocked domain and the name of the blocklist it was
+// found in
+func (b *Blocklist) Match(host string) (domain, name string, blocked bool) {
+	host = normaliseHost(host)
+	for d := host; d != ""; {
+		if _, exists := b.allowed[d]; exists {
+			return "", "", false
+		}
+		if name, exists := b.blocked[d]; exists {
+			return d, name, true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return "", "", false
+}
+
+// checkUrl checks the host of rawurl against b, returning an error
+// wrapping ErrHostBlocked if blocked
+func (b *Blocklist) checkUrl(rawurl string) error {
+	host := urlHost(rawurl)
+	if host == "" {
+		return nil
+	}
+	domain, name, blocked := b.Match(host)
+	if !blocked {
+		return nil
+	}
+	return fmt.Errorf("host %q blocked by blocklist %q (domain %q): %w",
+		host, name, domain, ErrHostBlocked)
+}
+
+// BlocklistDir returns the path of the directory containing blocklists
+func (db *DB) BlocklistDir() string {
+	return filepath.Join(db.Root, blocklistDir)
+}
+
+// Blocklists returns the names of all blocklists in db.BlocklistDir()
+func (db *DB) Blocklists() ([]string, error) {
+	files, err := ioutil.ReadDir(db.BlocklistDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if !f.Mode().IsRegular() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadBlocklist loads all blocklists in db.BlocklistDir(). A missing
+// blocklist directory is not an error, and returns an empty Blocklist.
+func (db *DB) LoadBlocklist() (*Blocklist, error) {
+	b := newBlocklist()
+
+	names, err := db.Blocklists()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		err = b.loadFile(filepath.Join(db.BlocklistDir(), name), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// loadFile loads blocklist rules from path, recording them against name
+func (b *Blocklist) loadFile(path, name string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	err = b.parse(fh, name)
+	if err != nil {
+		return fmt.Errorf("reading blocklist %q: %w", path, err)
+	}
+	return nil
+}
+
+// RefreshBlocklist atomically replaces (or creates) the blocklist name
+// with the contents of the file at path, returning the number of blocked
+// domains it contains. The new list is checked before being swapped in.
+func (db *DB) RefreshBlocklist(name, path string) (int, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".tmp") {
+		return 0, fmt.Errorf("invalid blocklist name %q", name)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	b := newBlocklist()
+	err = b.parse(bytes.NewReader(data), name)
+	if err != nil {
+		return 0, fmt.Errorf("reading blocklist %q: %w", path, err)
+	}
+	if b.Len() == 0 {
+		return 0, fmt.Errorf("blocklist %q contains no blocked domains", path)
+	}
+
+	err = os.MkdirAll(db.BlocklistDir(), 0755)
+	if err != nil {
+		return 0, err
+	}
+	target := filepath.Join(db.BlocklistDir(), name)
+	tmpfile := target + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(tmpfile, target)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.Len(), nil
+}
+
+// Audit checks all existing mappings against the current host policies
+// and blocklists, returning results for those that fail, sorted by code
+func (db *DB) Audit() ([]AuditResult, error) {
+	policy, err := db.readUrlPolicy()
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []AuditResult
+	for code, entry := range mappings {
+		err = policy.config.checkHost(entry.Url)
+		if err == nil {
+			err = policy.blocklist.checkUrl(entry.Url)
+		}
+		if err != nil {
+			results = append(results, AuditResult{Code: code, Url: entry.Url, Err: err})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Code < results[j].Code
+	})
+
+	return results, nil
+}
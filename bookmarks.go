@@ -0,0 +1,213 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for importing and exporting Netscape
+bookmark files, the HTML bookmark format used by all major browsers.
+
+On import, bookmark folders become tags and bookmark names become
+titles. On export, short links are grouped into folders by tag,
+within a top-level folder named for the usher domain.
+*/
+
+package usher
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// FormatBookmarks is the Netscape bookmark file import and export format
+const FormatBookmarks = "bookmarks"
+
+const bookmarksHeader = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+`
+
+// bookmarksRootAttrs are the attributes browsers use to mark their
+// built-in root folders, which are not useful as tags
+var bookmarksRootAttrs = []string{"personal_toolbar_folder", "unfiled_bookmarks_folder"}
+
+// isBookmarks returns true if data looks like a Netscape bookmark file
+func isBookmarks(data []byte) bool {
+	if len(data) > 512 {
+		data = data[:512]
+	}
+	return bytes.Contains(bytes.ToUpper(data), []byte("NETSCAPE-BOOKMARK-FILE"))
+}
+
+// parseBookmarks parses a Netscape bookmark file into import records
+func parseBookmarks(data []byte) ([]ImportRecord, error) {
+	var records []ImportRecord
+	var folders []string // folder tags, by <DL> nesting depth
+	folder := ""         // name of the last folder heading seen
+	var entry *Entry     // bookmark entry whose name we're reading
+	inFolderName := false
+
+	z := nethtml.NewTokenizer(bytes.NewReader(data))
+	for {
+		tt := z.Next()
+		switch tt {
+		case nethtml.ErrorToken:
+			if z.Err() == io.EOF {
+				return records, nil
+			}
+			return nil, z.Err()
+
+		case nethtml.StartTagToken:
+			token := z.Token()
+			switch token.Data {
+			case "dl":
+				folders = append(folders, folder)
+				folder = ""
+			case "h3":
+				inFolderName = true
+				folder = ""
+				for _, attr := range token.Attr {
+					for _, rootAttr := range bookmarksRootAttrs {
+						if attr.Key == rootAttr {
+							inFolderName = false
+						}
+					}
+				}
+			case "a":
+				entry = &Entry{}
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "href":
+						entry.Url = strings.TrimSpace(attr.Val)
+					case "add_date":
+						if secs, err := strconv.ParseInt(attr.Val, 10, 64); err == nil && secs > 0 {
+							entry.Created = time.Unix(secs, 0).UTC()
+						}
+					case "tags":
+						entry.Tags = splitTags(attr.Val)
+					case "shortcuturl":
+						entry.Code = strings.TrimSpace(attr.Val)
+					}
+				}
+				for _, f := range folders {
+					if f != "" {
+						entry.Tags = appendTag(entry.Tags, f)
+					}
+				}
+			}
+
+		case nethtml.TextToken:
+			text := string(z.Text())
+			switch {
+			case inFolderName:
+				folder += text
+			case entry != nil:
+				entry.Title += text
+			}
+
+		case nethtml.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "dl":
+				if len(folders) > 0 {
+					folders = folders[:len(folders)-1]
+				}
+			case "h3":
+				inFolderName = false
+				folder = folderTag(folder)
+			case "a":
+				if entry != nil {
+					entry.Title = strings.TrimSpace(entry.Title)
+					if entry.Title == entry.Url {
+						entry.Title = ""
+					}
+					records = append(records, ImportRecord{Row: len(records) + 1, Entry: *entry})
+					entry = nil
+				}
+			}
+		}
+	}
+}
+
+// folderTag converts a bookmark folder name to a tag
+func folderTag(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// appendTag appends tag to tags if not already present
+func appendTag(tags []string, tag string) []string {
+	for _, t := range tags {
+		if t == tag {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
+
+// exportBookmarks writes entries to w as a Netscape bookmark file of
+// short links, with entries grouped into folders by tag. Entries with
+// multiple tags appear in each of their folders.
+func exportBookmarks(w io.Writer, db *DB, entries []Entry) error {
+	var untagged []Entry
+	tagged := make(map[string][]Entry)
+	for _, entry := range entries {
+		if len(entry.Tags) == 0 {
+			untagged = append(untagged, entry)
+		}
+		for _, tag := range entry.Tags {
+			tagged[tag] = append(tagged[tag], entry)
+		}
+	}
+	tags := make([]string, 0, len(tagged))
+	for tag := range tagged {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	var b strings.Builder
+	b.WriteString(bookmarksHeader)
+	b.WriteString("<DL><p>\n")
+	fmt.Fprintf(&b, "    <DT><H3>%s</H3>\n", html.EscapeString(db.Domain))
+	b.WriteString("    <DL><p>\n")
+	for _, tag := range tags {
+		fmt.Fprintf(&b, "        <DT><H3>%s</H3>\n", html.EscapeString(tag))
+		b.WriteString("        <DL><p>\n")
+		for _, entry := range tagged[tag] {
+			writeBookmark(&b, db, entry, "            ")
+		}
+		b.WriteString("        </DL><p>\n")
+	}
+	for _, entry := range untagged {
+		writeBookmark(&b, db, entry, "        ")
+	}
+	b.WriteString("    </DL><p>\n")
+	b.WriteString("</DL><p>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeBookmark writes a bookmark for the short link for entry to b
+func writeBookmark(b *strings.Builder, db *DB, entry Entry, indent string) {
+	fmt.Fprintf(b, `%s<DT><A HREF="%s"`, indent, html.EscapeString(db.ShortUrl(entry.Code)))
+	if !entry.Created.IsZero() {
+		fmt.Fprintf(b, ` ADD_DATE="%d"`, entry.Created.Unix())
+	}
+	if len(entry.Tags) > 0 {
+		fmt.Fprintf(b, ` TAGS="%s"`, html.EscapeString(strings.Join(entry.Tags, ",")))
+	}
+	name := entry.Title
+	if name == "" {
+		name = entry.Code
+	}
+	fmt.Fprintf(b, ">%s</A>\n", html.EscapeString(name))
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
 
 	"github.com/alecthomas/kong"
 	"github.com/gavincarr/usher"
@@ -15,25 +22,100 @@ var CLI struct {
 
 	Ls struct {
 		//		Glob string `arg optional name:"glob" help:"Code glob of mappings to list."`
+		Private bool `help:"List only private mappings."`
+		Public  bool `help:"List only public mappings."`
 	} `cmd help:"List current mappings in the usher database."`
 
+	Find struct {
+		Query   string `arg name:"query" help:"Url or host to look up."`
+		Prefix  bool   `short:"p" help:"Match urls starting with <query>."`
+		Host    bool   `short:"H" help:"Match urls with host <query> (a leading dot also matches subdomains)."`
+		Private bool   `help:"Find only private mappings."`
+		Public  bool   `help:"Find only public mappings."`
+	} `cmd help:"Find mappings by url or host."`
+
 	Add struct {
-		Url  string `arg name:"url" help:"Url to redirect to."`
-		Code string `arg optional name:"code" help:"Code to be used for mapping."`
+		Url     string `arg name:"url" help:"Url to redirect to."`
+		Code    string `arg optional name:"code" help:"Code to be used for mapping."`
+		Force   bool   `short:"f" help:"Skip url validation and normalisation."`
+		New     bool   `short:"n" help:"Generate a new random code even if url is already mapped."`
+		Private bool   `short:"p" help:"Mark mapping private, so it is never listed publicly or exported."`
 	} `cmd help:"Add a new mapping to the usher database."`
 
 	Update struct {
-		Url  string `arg name:"url" help:"Url to redirect to."`
-		Code string `arg name:"code" help:"Code to be updated."`
+		Url   string `arg name:"url" help:"Url to redirect to."`
+		Code  string `arg name:"code" help:"Code to be updated."`
+		Force bool   `short:"f" help:"Skip url validation and normalisation."`
 	} `cmd help:"Update the url for an existing mapping in the usher database."`
 
+	Set struct {
+		Code    string `arg name:"code" help:"Code of mapping to change."`
+		Title   string `help:"Set the title (an empty string clears it)." default:"-"`
+		Tags    string `help:"Set the tags, comma-separated (an empty string clears them)." default:"-"`
+		Private bool   `help:"Mark mapping private, so it is never listed publicly or exported."`
+		Public  bool   `help:"Mark mapping public."`
+	} `cmd help:"Change attributes of an existing mapping."`
+
+	Batch struct {
+		File            string `arg optional name:"file" type:"existingfile" help:"File to read operations from (default: stdin)."`
+		ContinueOnError bool   `name:"continue-on-error" help:"Apply successful operations even if some fail."`
+	} `cmd help:"Apply add/update/rm operations (as lines or JSON Lines) in a single batch."`
+
+	Import struct {
+		File       string `arg name:"file" type:"existingfile" help:"File to import mappings from."`
+		Format     string `enum:",csv,tsv,json,yaml,yourls,shlink,bitly,kutt,bookmarks" help:"Import format (csv, tsv, json, yaml, yourls, shlink, bitly, kutt, bookmarks; default: detect)."`
+		Columns    string `help:"Column mappings for usher fields, as field=column pairs e.g. code=Short,url=Target (columns may be names or 1-based indexes)."`
+		OnConflict string `name:"on-conflict" enum:"fail,skip,overwrite,rename" default:"fail" help:"Action for codes that already exist with a different url (fail, skip, overwrite, rename)."`
+		DryRun     bool   `name:"dry-run" help:"Report what would be imported without changing anything."`
+		Force      bool   `short:"f" help:"Skip url validation and normalisation."`
+	} `cmd help:"Import mappings from a CSV, TSV, JSON, YAML or bookmarks file."`
+
+	Export struct {
+		Format string `enum:"bookmarks,html,markdown,atom,opml" default:"bookmarks" help:"Export format (bookmarks, html, markdown, atom, opml)."`
+		Output string `short:"o" help:"File to write to (default: stdout)."`
+	} `cmd help:"Export public short links as bookmarks, an HTML directory, Markdown, an Atom feed, or OPML."`
+
+	Rewrite struct {
+		From   string `help:"Regular expression to match in urls."`
+		To     string `help:"Replacement for --from matches (may include $1-style references)."`
+		Host   string `help:"Host migration, as old=new."`
+		DryRun bool   `name:"dry-run" help:"Print changes without updating the database."`
+		Force  bool   `short:"f" help:"Skip url validation and normalisation of rewritten urls."`
+	} `cmd help:"Rewrite urls of all matching mappings."`
+
 	Rm struct {
 		Code string `arg name:"code" help:"Code of mapping to remove from the database."`
 	} `cmd help:"Remove a mapping from the usher database."`
 
 	Push struct {
+		DryRun  bool `name:"dry-run" help:"Print the changes a push would make, without pushing."`
+		NoPrune bool `name:"no-prune" help:"Don't delete published codes that have been removed locally."`
+		Force   bool `help:"Push even if it would delete more codes than the backend's safety limit."`
+		Resume  bool `help:"Continue an interrupted or partly failed push, where supported by the backend."`
 	} `cmd help:"Push mappings to the configured backend."`
 
+	Dedupe struct {
+		Remove bool `help:"Remove all but the canonical code of each set of duplicates."`
+		DryRun bool `name:"dry-run" help:"With --remove, report the codes that would be removed without removing them."`
+	} `cmd help:"Find mappings with duplicate urls (and the same visibility), and optionally remove the extras."`
+
+	Audit struct {
+	} `cmd help:"Check all mappings against current host policies and blocklists."`
+
+	Setup struct {
+		Backend string `arg name:"backend" enum:"s3" help:"Backend type to set up (s3)."`
+		IAMUser string `name:"iam-user" help:"IAM user to create (if missing) and grant write access to the bucket (s3 on AWS only)."`
+		Yes     bool   `short:"y" help:"Apply changes without asking for confirmation."`
+	} `cmd help:"Create and configure the infrastructure for a backend (e.g. an S3 bucket, website hosting, and access policies)."`
+
+	Doctor struct {
+	} `cmd help:"Check the usher database, config, and backend setup (including which credentials are used)."`
+
+	Blocklist struct {
+		Name        string `arg optional name:"name" help:"Name of blocklist to refresh."`
+		RefreshFrom string `name:"refresh-from" type:"existingfile" help:"Replace blocklist <name> with the contents of this file."`
+	} `cmd help:"List blocklists, or refresh a blocklist from a file."`
+
 	Root struct {
 	} `cmd help:"Print the location of the usher root directory."`
 
@@ -44,6 +126,77 @@ var CLI struct {
 	} `cmd help:"Print the location of the usher database file."`
 }
 
+// listOptions returns the ListOptions for the --private and --public
+// flags, which are mutually exclusive
+func listOptions(private, public bool) usher.ListOptions {
+	opts := usher.ListOptions{}
+	switch {
+	case private && public:
+		log.Fatal("Error: --private and --public are mutually exclusive")
+	case private:
+		opts.Visibility = usher.ListPrivate
+	case public:
+		opts.Visibility = usher.ListPublic
+	}
+	return opts
+}
+
+// printEntries prints entries in our standard listing format
+func printEntries(entries []usher.Entry) {
+	for _, e := range entries {
+		fmt.Printf("%-12s %s\n", e.Code, e.Url)
+	}
+}
+
+// interruptContext returns a context that is cancelled on the first
+// SIGINT. Subsequent interrupts kill the process as usual.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		fmt.Fprintln(os.Stderr, "Interrupted, cancelling...")
+		cancel()
+	}()
+	return ctx
+}
+
+// printPlan prints the changes in plan, and a summary of counts
+func printPlan(plan *usher.Plan) {
+	for _, c := range plan.Changes {
+		switch c.Action {
+		case usher.ActionCreate:
+			fmt.Printf("+ %-12s %s\n", c.Code, c.Url)
+		case usher.ActionUpdate:
+			fmt.Printf("~ %-12s %s => %s\n", c.Code, c.OldUrl, c.Url)
+		case usher.ActionDelete:
+			fmt.Printf("- %-12s %s\n", c.Code, c.OldUrl)
+		}
+	}
+	fmt.Printf("%d to create, %d to update, %d to delete, %d unchanged\n",
+		plan.Count(usher.ActionCreate), plan.Count(usher.ActionUpdate),
+		plan.Count(usher.ActionDelete), plan.Count(usher.ActionUnchanged))
+}
+
+// printImportSummary prints the results of an import
+func printImportSummary(summary *usher.ImportSummary, dryRun bool) {
+	for _, rename := range summary.Renames {
+		fmt.Printf("renamed %s => %s\n", rename.Original, rename.New)
+	}
+	for _, e := range summary.Invalid {
+		fmt.Printf("invalid %s\n", e)
+	}
+	prefix := ""
+	if dryRun {
+		prefix = "(dry run) "
+	}
+	fmt.Printf("%s%d added, %d overwritten, %d renamed, %d skipped, %d unchanged, %d invalid\n",
+		prefix, summary.Added, summary.Overwritten, summary.Renamed, summary.Skipped,
+		summary.Unchanged, len(summary.Invalid))
+}
+
 func main() {
 	log.SetFlags(0)
 	ctx := kong.Parse(&CLI)
@@ -69,23 +222,43 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		entries, err := db.List("")
+		entries, err := db.ListWithOptions(listOptions(CLI.Ls.Private, CLI.Ls.Public))
+		if err != nil {
+			log.Fatal(err)
+		}
+		printEntries(entries)
+
+	case "find <query>":
+		db, err := usher.NewDB("")
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, e := range entries {
-			fmt.Printf("%-12s %s\n", e.Code, e.Url)
+		// Default to exact url matches for urls, and host matches otherwise
+		mode := usher.FindExact
+		if CLI.Find.Prefix {
+			mode = usher.FindPrefix
+		} else if CLI.Find.Host || !strings.Contains(CLI.Find.Query, "://") {
+			mode = usher.FindHost
+		}
+		entries, err := db.FindByURLWithOptions(CLI.Find.Query, mode,
+			listOptions(CLI.Find.Private, CLI.Find.Public))
+		if err != nil {
+			log.Fatal(err)
 		}
+		printEntries(entries)
 
 	case "add <url> <code>":
 		db, err := usher.NewDB("")
 		if err != nil {
 			log.Fatal(err)
 		}
-		_, err = db.Add(CLI.Add.Url, CLI.Add.Code)
+		_, _, err = db.AddWithOptions(CLI.Add.Url, CLI.Add.Code,
+			usher.AddOptions{Force: CLI.Add.Force, Private: CLI.Add.Private})
 		if err != nil {
 			if err == usher.ErrCodeExists {
 				log.Fatalf("Error: code %q already exists in usher database\n", CLI.Add.Code)
+			} else if errors.Is(err, usher.ErrUrlBad) {
+				log.Fatalf("Error: %s (use --force to override)\n", err)
 			} else {
 				log.Fatal(err)
 			}
@@ -96,10 +269,18 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		code, err := db.Add(CLI.Add.Url, "")
+		code, existing, err := db.AddWithOptions(CLI.Add.Url, "",
+			usher.AddOptions{Force: CLI.Add.Force, New: CLI.Add.New, Private: CLI.Add.Private})
 		if err != nil {
+			if errors.Is(err, usher.ErrUrlBad) {
+				log.Fatalf("Error: %s (use --force to override)\n", err)
+			}
 			log.Fatal(err)
 		}
+		if existing {
+			fmt.Printf("Url already mapped with code %q (use --new to force a new code)\n", code)
+			return
+		}
 		fmt.Printf("Added mapping with code %q\n", code)
 
 	case "update <url> <code>":
@@ -107,15 +288,177 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = db.Update(CLI.Update.Url, CLI.Update.Code)
+		err = db.UpdateWithOptions(CLI.Update.Url, CLI.Update.Code, usher.UpdateOptions{Force: CLI.Update.Force})
 		if err != nil {
 			if err == usher.ErrNotFound {
 				log.Fatalf("Error: code %q not found in usher database\n", CLI.Update.Code)
+			} else if errors.Is(err, usher.ErrUrlBad) {
+				log.Fatalf("Error: %s (use --force to override)\n", err)
 			} else {
 				log.Fatal(err)
 			}
 		}
 
+	case "set <code>":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var opts usher.SetOptions
+		if CLI.Set.Title != "-" {
+			opts.Title = &CLI.Set.Title
+		}
+		if CLI.Set.Tags != "-" {
+			opts.Tags = []string{}
+			for _, tag := range strings.Split(CLI.Set.Tags, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					opts.Tags = append(opts.Tags, tag)
+				}
+			}
+		}
+		switch {
+		case CLI.Set.Private && CLI.Set.Public:
+			log.Fatal("Error: --private and --public are mutually exclusive")
+		case CLI.Set.Private, CLI.Set.Public:
+			opts.Private = &CLI.Set.Private
+		}
+		err = db.Set(CLI.Set.Code, opts)
+		if err != nil {
+			if err == usher.ErrNotFound {
+				log.Fatalf("Error: code %q not found in usher database\n", CLI.Set.Code)
+			}
+			log.Fatal("Error: " + err.Error())
+		}
+
+	case "batch", "batch <file>":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		input := os.Stdin
+		if CLI.Batch.File != "" {
+			input, err = os.Open(CLI.Batch.File)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer input.Close()
+		}
+		failures := 0
+		err = db.Batch(func(tx *usher.Tx) error {
+			scanner := bufio.NewScanner(input)
+			lineno := 0
+			for scanner.Scan() {
+				lineno++
+				op, err := usher.ParseBatchOp(scanner.Text())
+				if err == nil && op == nil {
+					continue
+				}
+				var code string
+				if err == nil {
+					code, err = tx.Apply(op)
+				}
+				if err != nil {
+					failures++
+					fmt.Printf("%d: error: %s\n", lineno, err)
+					if !CLI.Batch.ContinueOnError {
+						return fmt.Errorf("batch aborted at line %d, no changes made", lineno)
+					}
+					continue
+				}
+				fmt.Printf("%d: ok %s %s\n", lineno, op.Op, code)
+			}
+			return scanner.Err()
+		})
+		if err != nil {
+			log.Fatal("Error: " + err.Error())
+		}
+		if failures > 0 {
+			log.Fatalf("Error: %d operation(s) failed\n", failures)
+		}
+
+	case "import <file>":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		columns := make(map[string]string)
+		if CLI.Import.Columns != "" {
+			for _, pair := range strings.Split(CLI.Import.Columns, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					log.Fatalf("Error: invalid column mapping %q, expected field=column\n", pair)
+				}
+				columns[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+		summary, err := db.ImportFile(CLI.Import.File, usher.ImportOptions{
+			Format:     CLI.Import.Format,
+			Columns:    columns,
+			OnConflict: CLI.Import.OnConflict,
+			DryRun:     CLI.Import.DryRun,
+			Force:      CLI.Import.Force,
+		})
+		if err != nil {
+			log.Fatal("Error: " + err.Error())
+		}
+		printImportSummary(summary, CLI.Import.DryRun)
+
+	case "export":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		out := os.Stdout
+		if CLI.Export.Output != "" {
+			out, err = os.Create(CLI.Export.Output)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err = db.Export(out, usher.ExportOptions{Format: CLI.Export.Format})
+		if err != nil {
+			log.Fatal("Error: " + err.Error())
+		}
+		err = out.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "rewrite":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts := usher.RewriteOptions{DryRun: CLI.Rewrite.DryRun, Force: CLI.Rewrite.Force}
+		var rewrites []usher.Rewrite
+		switch {
+		case CLI.Rewrite.Host != "" && CLI.Rewrite.From == "":
+			hosts := strings.SplitN(CLI.Rewrite.Host, "=", 2)
+			if len(hosts) != 2 {
+				log.Fatalf("Error: invalid --host %q, expected old=new\n", CLI.Rewrite.Host)
+			}
+			rewrites, err = db.RewriteHost(hosts[0], hosts[1], opts)
+		case CLI.Rewrite.From != "" && CLI.Rewrite.Host == "":
+			from, rerr := regexp.Compile(CLI.Rewrite.From)
+			if rerr != nil {
+				log.Fatalf("Error: invalid --from regex: %s\n", rerr)
+			}
+			rewrites, err = db.RewriteRegexp(from, CLI.Rewrite.To, opts)
+		default:
+			log.Fatal("Error: exactly one of --from or --host is required")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range rewrites {
+			fmt.Printf("%s\n  - %s\n  + %s\n", r.Code, r.OldUrl, r.NewUrl)
+		}
+		if CLI.Rewrite.DryRun {
+			fmt.Printf("%d mapping(s) would be rewritten\n", len(rewrites))
+		} else {
+			fmt.Printf("%d mapping(s) rewritten\n", len(rewrites))
+		}
+
 	case "rm <code>":
 		db, err := usher.NewDB("")
 		if err != nil {
@@ -156,14 +499,154 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = db.Push()
+		opts := usher.PushOptions{
+			NoPrune: CLI.Push.NoPrune,
+			Force:   CLI.Push.Force,
+			Resume:  CLI.Push.Resume,
+			Context: interruptContext(),
+		}
+		if CLI.Push.DryRun {
+			plan, err := db.PlanWithOptions(opts)
+			if err != nil {
+				log.Fatal("Error: " + err.Error())
+			}
+			printPlan(plan)
+			return
+		}
+		plan, err := db.PushWithOptions(opts)
 		if err != nil {
+			var errs usher.PushErrors
 			if err == usher.ErrPushTypeUnconfigured {
 				log.Fatalf("Error: backend `type` is not configured in config %q\n", db.ConfigPath)
+			} else if errors.As(err, &errs) {
+				log.Fatalf("Error: %s\nRetry the failed codes with `usher push --resume`\n", err)
 			} else {
 				log.Fatal("Error: " + err.Error())
 			}
 		}
+		fmt.Printf("%d created, %d updated, %d deleted, %d unchanged\n",
+			plan.Count(usher.ActionCreate), plan.Count(usher.ActionUpdate),
+			plan.Count(usher.ActionDelete), plan.Count(usher.ActionUnchanged))
+
+	case "dedupe":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dups [][]string
+		action := "duplicates"
+		switch {
+		case CLI.Dedupe.Remove && CLI.Dedupe.DryRun:
+			dups, err = db.Duplicates()
+			action = "would remove"
+		case CLI.Dedupe.Remove:
+			dups, err = db.Dedupe()
+			action = "removed"
+		default:
+			dups, err = db.Duplicates()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, codes := range dups {
+			fmt.Printf("%-12s %s: %s\n", codes[0], action, strings.Join(codes[1:], " "))
+		}
+
+	case "audit":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		results, err := db.Audit()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range results {
+			fmt.Printf("%-12s %s\n  %s\n", r.Code, r.Url, r.Err)
+		}
+		if len(results) > 0 {
+			log.Fatalf("Error: %d mapping(s) failed audit\n", len(results))
+		}
+
+	case "setup <backend>":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		setup, err := db.Setup(CLI.Setup.Backend, usher.SetupOptions{IAMUser: CLI.Setup.IAMUser})
+		if err != nil {
+			log.Fatal("Error: " + err.Error())
+		}
+		if len(setup.Changes) == 0 {
+			fmt.Println("Nothing to change - setup is complete")
+			return
+		}
+		fmt.Println("Setup will make the following changes:")
+		for _, change := range setup.Changes {
+			fmt.Printf("  + %s\n", change.Description)
+		}
+		if !CLI.Setup.Yes {
+			fmt.Print("Apply these changes? [y/N] ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			if answer != "y" && answer != "yes" {
+				fmt.Println("No changes made")
+				return
+			}
+		}
+		err = setup.Apply()
+		if err != nil {
+			log.Fatal("Error: " + err.Error())
+		}
+		fmt.Printf("Applied %d change(s)\n", len(setup.Changes))
+
+	case "doctor":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		failed := false
+		for _, c := range db.Doctor() {
+			if c.Err != nil {
+				fmt.Printf("FAIL %-16s %s\n", c.Name, c.Err)
+				failed = true
+			} else {
+				fmt.Printf("ok   %-16s %s\n", c.Name, c.Result)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case "blocklist":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if CLI.Blocklist.RefreshFrom != "" {
+			log.Fatal("Error: --refresh-from requires a blocklist <name>")
+		}
+		names, err := db.Blocklists()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+
+	case "blocklist <name>":
+		db, err := usher.NewDB("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if CLI.Blocklist.RefreshFrom == "" {
+			log.Fatal("Error: missing --refresh-from <file>")
+		}
+		count, err := db.RefreshBlocklist(CLI.Blocklist.Name, CLI.Blocklist.RefreshFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Refreshed blocklist %q with %d domains\n", CLI.Blocklist.Name, count)
 
 	default:
 		log.Fatalf("unknown command %q\n", ctx.Command())
@@ -0,0 +1,131 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for normalising and checking codes.
+
+Codes may use any script (and emoji), but are always normalised to
+Unicode NFC before being stored or looked up, so that visually
+identical codes (e.g. a precomposed "é" vs. "e" + combining acute)
+cannot coexist in the database. Codes that mix letters from
+unrelated scripts (e.g. Latin and Cyrillic) are rejected, since
+they are a classic source of lookalike (confusable) codes.
+*/
+
+package usher
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const zeroWidthJoiner = '\u200d'
+
+// codeScripts are the scripts we check code letters against.
+// Letters not in any of these scripts are allowed, but count
+// as their own (unknown) script.
+var codeScripts = map[string]*unicode.RangeTable{
+	"Arabic":     unicode.Arabic,
+	"Armenian":   unicode.Armenian,
+	"Bengali":    unicode.Bengali,
+	"Bopomofo":   unicode.Bopomofo,
+	"Cyrillic":   unicode.Cyrillic,
+	"Devanagari": unicode.Devanagari,
+	"Ethiopic":   unicode.Ethiopic,
+	"Georgian":   unicode.Georgian,
+	"Greek":      unicode.Greek,
+	"Gujarati":   unicode.Gujarati,
+	"Gurmukhi":   unicode.Gurmukhi,
+	"Han":        unicode.Han,
+	"Hangul":     unicode.Hangul,
+	"Hebrew":     unicode.Hebrew,
+	"Hiragana":   unicode.Hiragana,
+	"Kannada":    unicode.Kannada,
+	"Katakana":   unicode.Katakana,
+	"Khmer":      unicode.Khmer,
+	"Lao":        unicode.Lao,
+	"Latin":      unicode.Latin,
+	"Malayalam":  unicode.Malayalam,
+	"Myanmar":    unicode.Myanmar,
+	"Sinhala":    unicode.Sinhala,
+	"Tamil":      unicode.Tamil,
+	"Telugu":     unicode.Telugu,
+	"Thai":       unicode.Thai,
+}
+
+// compatibleScripts lists script combinations that are legitimately
+// used together, and so are not treated as mixed-script
+var compatibleScripts = map[string]bool{
+	"Han+Hiragana":          true,
+	"Han+Katakana":          true,
+	"Hiragana+Katakana":     true,
+	"Han+Hiragana+Katakana": true,
+	"Han+Hangul":            true,
+	"Bopomofo+Han":          true,
+}
+
+// NormaliseCode returns code normalised to Unicode NFC
+func NormaliseCode(code string) string {
+	return norm.NFC.String(code)
+}
+
+// checkCode checks that a (normalised) code is usable, returning an
+// error wrapping ErrCodeBad if not
+func checkCode(code string) error {
+	if code == "" {
+		return fmt.Errorf("empty code: %w", ErrCodeBad)
+	}
+
+	scripts := make(map[string]bool)
+	for _, r := range code {
+		switch {
+		case r == unicode.ReplacementChar:
+			return fmt.Errorf("code %q is not valid UTF-8: %w", code, ErrCodeBad)
+		case unicode.IsSpace(r), unicode.IsControl(r):
+			return fmt.Errorf("code %q contains whitespace or control characters: %w",
+				code, ErrCodeBad)
+		case unicode.Is(unicode.Cf, r) && r != zeroWidthJoiner:
+			// Format characters are invisible, except for ZWJ, which is
+			// required for emoji sequences
+			return fmt.Errorf("code %q contains invisible character %U: %w",
+				code, r, ErrCodeBad)
+		case unicode.IsLetter(r):
+			scripts[letterScript(r)] = true
+		}
+	}
+
+	if len(scripts) > 1 {
+		names := make([]string, 0, len(scripts))
+		for name := range scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		combo := strings.Join(names, "+")
+		if !compatibleScripts[combo] {
+			return fmt.Errorf("code %q mixes scripts %s: %w", code, combo, ErrCodeBad)
+		}
+	}
+
+	return nil
+}
+
+// letterScript returns the name of the script for letter r
+func letterScript(r rune) string {
+	for name, table := range codeScripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return fmt.Sprintf("Unknown(%U)", r)
+}
+
+// codePath returns the percent-encoded url path for code,
+// for backends that match on raw request paths
+func codePath(code string) string {
+	u := url.URL{Path: "/" + code}
+	return u.EscapedPath()
+}
@@ -0,0 +1,133 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for detecting and removing mappings
+that share the same destination url.
+
+Urls are compared in normalised form (see urlKey), so e.g.
+`HTTPS://Example.com:443` and `https://example.com/` are treated
+as duplicates. Only mappings with the same visibility are duplicates,
+so removing extras never changes which urls are public. Within a set
+of duplicates, the "canonical" code is
+the one we keep when removing extras - explicit codes are preferred
+over random ones, then shorter codes, then lexically first.
+*/
+
+package usher
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// reRandomCode matches codes that look like they were generated by randomCode
+var reRandomCode = regexp.MustCompile(fmt.Sprintf(`^[%s][%s]{%d,%d}$`,
+	digits, chars, minRandomCodeLen-1, maxRandomCodeLen-1))
+
+// CodesForUrl returns the codes of all mappings whose url matches url
+// (in normalised form), canonical code first
+func (db *DB) CodesForUrl(url string) ([]string, error) {
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	return codesForUrl(mappings, url), nil
+}
+
+// Duplicates returns all sets of codes that share the same destination
+// url (in normalised form) and visibility, canonical code first. Sets are sorted by
+// canonical code.
+func (db *DB) Duplicates() ([][]string, error) {
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	return duplicates(mappings), nil
+}
+
+// Dedupe removes all but the canonical code from each set of duplicate
+// mappings in a single database update, returning the sets of
+// duplicates found (canonical code first)
+func (db *DB) Dedupe() ([][]string, error) {
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+
+	dups := duplicates(mappings)
+	if len(dups) == 0 {
+		return dups, nil
+	}
+
+	for _, codes := range dups {
+		for _, code := range codes[1:] {
+			delete(mappings, code)
+		}
+	}
+
+	err = db.writeDB(mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	return dups, nil
+}
+
+// codesForUrl returns the codes in mappings whose url matches url
+// (in normalised form), canonical code first
+func codesForUrl(mappings map[string]*Entry, url string) []string {
+	key := urlKey(url)
+	var codes []string
+	for code, entry := range mappings {
+		if urlKey(entry.Url) == key {
+			codes = append(codes, code)
+		}
+	}
+	sortCanonical(codes)
+	return codes
+}
+
+// duplicateKey is the key duplicate mappings share
+type duplicateKey struct {
+	url     string // normalised url
+	private bool
+}
+
+// duplicates returns all sets of codes in mappings sharing the same
+// url (in normalised form) and visibility, canonical code first
+func duplicates(mappings map[string]*Entry) [][]string {
+	byUrl := make(map[duplicateKey][]string)
+	for code, entry := range mappings {
+		key := duplicateKey{url: urlKey(entry.Url), private: entry.Private}
+		byUrl[key] = append(byUrl[key], code)
+	}
+
+	var dups [][]string
+	for _, codes := range byUrl {
+		if len(codes) < 2 {
+			continue
+		}
+		sortCanonical(codes)
+		dups = append(dups, codes)
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		return dups[i][0] < dups[j][0]
+	})
+	return dups
+}
+
+// sortCanonical sorts codes in order of preference for keeping:
+// explicit before random codes, then shortest, then lexically
+func sortCanonical(codes []string) {
+	sort.Slice(codes, func(i, j int) bool {
+		ri, rj := reRandomCode.MatchString(codes[i]), reRandomCode.MatchString(codes[j])
+		if ri != rj {
+			return rj
+		}
+		if len(codes[i]) != len(codes[j]) {
+			return len(codes[i]) < len(codes[j])
+		}
+		return codes[i] < codes[j]
+	})
+}
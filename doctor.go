@@ -0,0 +1,59 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for diagnosing usher setup problems,
+used by `usher doctor`. Backends can add their own checks by
+implementing the BackendDoctor interface.
+*/
+
+package usher
+
+import (
+	"fmt"
+)
+
+// Check is the result of a single diagnostic check
+type Check struct {
+	Name   string // what was checked
+	Result string // what was found
+	Err    error  // why the check failed, if it did
+}
+
+// BackendDoctor is implemented by backends that can diagnose their
+// own configuration e.g. credentials and remote access
+type BackendDoctor interface {
+	Doctor() []Check
+}
+
+// Doctor runs diagnostic checks on the database, config, and configured
+// backend, and returns the results. Checks stop at the first failure
+// that later checks depend on.
+func (db *DB) Doctor() []Check {
+	var checks []Check
+
+	entries, err := db.readDB()
+	if err != nil {
+		return append(checks, Check{Name: "database", Err: err})
+	}
+	checks = append(checks, Check{
+		Name:   "database",
+		Result: fmt.Sprintf("%s (%d mappings)", db.DBPath, len(entries)),
+	})
+
+	config, err := db.readConfig()
+	if err != nil {
+		return append(checks, Check{Name: "config", Err: err})
+	}
+	checks = append(checks, Check{Name: "config", Result: db.ConfigPath})
+
+	backend, err := db.backend(config)
+	if err != nil {
+		return append(checks, Check{Name: "backend", Err: err})
+	}
+	checks = append(checks, Check{Name: "backend", Result: config.Type})
+
+	if doctor, ok := backend.(BackendDoctor); ok {
+		checks = append(checks, doctor.Doctor()...)
+	}
+	return checks
+}
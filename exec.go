@@ -0,0 +1,276 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for external executable backends, which
+are configured either with `type: exec` and a `command` option, or
+with `type: NAME`, where `usher-backend-NAME` is an executable on the
+PATH. Usher runs the executable once per operation, sending a JSON
+request on stdin, and reading a JSON response from stdout.
+
+See `Exec.md` for the protocol details.
+*/
+
+package usher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// ExecProtocolVersion is the exec backend protocol version usher speaks
+const ExecProtocolVersion = 1
+
+// execBackendPrefix is the prefix for exec backends found on the PATH
+const execBackendPrefix = "usher-backend-"
+
+// ErrNotSupported is returned for operations an exec backend doesn't support
+var ErrNotSupported = errors.New("operation not supported by backend")
+
+// execRequest is a request sent to an exec backend on stdin
+type execRequest struct {
+	Protocol int                    `json:"protocol"`
+	Op       string                 `json:"op"`
+	Domain   string                 `json:"domain"`
+	Options  map[string]interface{} `json:"options"`
+	Mappings map[string]string      `json:"mappings,omitempty"`
+	Prune    bool                   `json:"prune,omitempty"`
+}
+
+// execResult is the result of an exec backend push for a single code
+type execResult struct {
+	Code   string `json:"code"`
+	Action Action `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// execResponse is a response read from an exec backend on stdout
+type execResponse struct {
+	Protocol     int               `json:"protocol"`
+	Name         string            `json:"name,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Mappings     map[string]string `json:"mappings,omitempty"`
+	Changes      []Change          `json:"changes,omitempty"`
+	Results      []execResult      `json:"results,omitempty"`
+}
+
+// execBackend is a backend implemented by an external executable
+type execBackend struct {
+	db           *DB
+	command      string
+	args         []string
+	options      map[string]interface{}
+	capabilities map[string]bool
+}
+
+func init() {
+	RegisterBackend("exec", newExecBackend)
+}
+
+// newExecBackend returns a new exec backend for db using config. The
+// `command` and `args` options are used by usher, and all other options
+// are passed through to the command.
+func newExecBackend(db *DB, config *ConfigEntry) (Backend, error) {
+	b := &execBackend{db: db, options: make(map[string]interface{})}
+	for key, value := range config.Options {
+		switch key {
+		case "command":
+			command, ok := value.(string)
+			if !ok {
+				return nil, errors.New("exec backend option 'command' must be a string")
+			}
+			b.command = command
+		case "args":
+			args, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.New("exec backend option 'args' must be a list")
+			}
+			for _, arg := range args {
+				b.args = append(b.args, fmt.Sprint(arg))
+			}
+		default:
+			b.options[key] = value
+		}
+	}
+	if b.command == "" {
+		return nil, errors.New("exec backend requires a 'command' option")
+	}
+	return b, nil
+}
+
+// lookupExecBackend returns a new exec backend for config if there is
+// an `usher-backend-TYPE` executable on the PATH, or nil if not
+func lookupExecBackend(db *DB, config *ConfigEntry) (Backend, error) {
+	path, err := exec.LookPath(execBackendPrefix + config.Type)
+	if err != nil {
+		return nil, nil
+	}
+	options := config.Options
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	return &execBackend{db: db, command: path, options: options}, nil
+}
+
+// call runs the backend command with a request for op, and returns
+// the decoded response
+func (b *execBackend) call(op string, mappings map[string]string, opts PushOptions) (*execResponse, error) {
+	req := execRequest{
+		Protocol: ExecProtocolVersion,
+		Op:       op,
+		Domain:   b.db.Domain,
+		Options:  b.options,
+		Mappings: mappings,
+		Prune:    mappings != nil && !opts.NoPrune,
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(opts.ctx(), b.command, b.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("backend %q %s failed: %s: %s", b.command, op, err, msg)
+		}
+		return nil, fmt.Errorf("backend %q %s failed: %s", b.command, op, err)
+	}
+
+	var resp execResponse
+	err = json.Unmarshal(stdout.Bytes(), &resp)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q %s returned invalid json: %s", b.command, op, err)
+	}
+	if resp.Protocol != ExecProtocolVersion {
+		return nil, fmt.Errorf("backend %q %s returned protocol version %d (usher supports %d)",
+			b.command, op, resp.Protocol, ExecProtocolVersion)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("backend %q %s failed: %s", b.command, op, resp.Error)
+	}
+	return &resp, nil
+}
+
+// handshake checks the backend speaks our protocol version, and records
+// its capabilities
+func (b *execBackend) handshake() error {
+	if b.capabilities != nil {
+		return nil
+	}
+	resp, err := b.call("handshake", nil, PushOptions{})
+	if err != nil {
+		return err
+	}
+	b.capabilities = make(map[string]bool)
+	for _, op := range resp.Capabilities {
+		b.capabilities[op] = true
+	}
+	if !b.capabilities["push"] {
+		return fmt.Errorf("backend %q does not support push", b.command)
+	}
+	return nil
+}
+
+// Validate performs the protocol handshake, and then has the backend
+// validate its options, if supported
+func (b *execBackend) Validate() error {
+	err := b.handshake()
+	if err != nil {
+		return err
+	}
+	if !b.capabilities["validate"] {
+		return nil
+	}
+	_, err = b.call("validate", nil, PushOptions{})
+	return err
+}
+
+// Plan returns the backend's plan for a push of mappings if supported,
+// or else a plan based on the backend's current mappings from Pull
+func (b *execBackend) Plan(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	err := b.handshake()
+	if err != nil {
+		return nil, err
+	}
+	if !b.capabilities["plan"] {
+		current, err := b.Pull()
+		if err != nil {
+			return nil, err
+		}
+		return diffMappings(current, mappings, !opts.NoPrune), nil
+	}
+
+	resp, err := b.call("plan", mappings, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Changes: resp.Changes}
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].Code < plan.Changes[j].Code
+	})
+	return plan, nil
+}
+
+// Push sends mappings to the backend, and returns the changes it
+// reports making. Per-code failures reported by the backend are
+// returned as PushErrors.
+func (b *execBackend) Push(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	err := b.handshake()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.call("push", mappings, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	var errs PushErrors
+	for _, result := range resp.Results {
+		if result.Error != "" {
+			errs = append(errs, CodeError{Code: result.Code, Err: errors.New(result.Error)})
+			continue
+		}
+		change := Change{Code: result.Code, Action: result.Action}
+		if result.Action != ActionDelete {
+			change.Url = mappings[result.Code]
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].Code < plan.Changes[j].Code
+	})
+	if len(errs) > 0 {
+		return plan, errs
+	}
+	return plan, nil
+}
+
+// Pull returns the backend's current mappings, if supported
+func (b *execBackend) Pull() (map[string]string, error) {
+	err := b.handshake()
+	if err != nil {
+		return nil, err
+	}
+	if !b.capabilities["pull"] {
+		return nil, fmt.Errorf("backend %q pull: %w", b.command, ErrNotSupported)
+	}
+	resp, err := b.call("pull", nil, PushOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Mappings == nil {
+		resp.Mappings = make(map[string]string)
+	}
+	return resp.Mappings, nil
+}
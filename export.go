@@ -0,0 +1,360 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for exporting mappings as short links,
+in formats suitable for browsers and other tools:
+
+- bookmarks: a Netscape bookmark file (see bookmarks.go)
+- html: a standalone, sortable and searchable HTML link directory
+- markdown: a Markdown table
+- atom: an Atom feed, newest links first
+- opml: an OPML outline
+
+Exports are built from List output, and never include private entries.
+*/
+
+package usher
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+	FormatAtom     = "atom"
+	FormatOPML     = "opml"
+)
+
+// exporters are the writers for export formats
+var exporters = map[string]func(w io.Writer, db *DB, entries []Entry) error{
+	FormatBookmarks: exportBookmarks,
+	FormatHTML:      exportHTML,
+	FormatMarkdown:  exportMarkdown,
+	FormatAtom:      exportAtom,
+	FormatOPML:      exportOPML,
+}
+
+// ExportOptions are the settings used by Export
+type ExportOptions struct {
+	Format string // export format
+}
+
+// ExportFormats returns the names of the supported export formats
+func ExportFormats() []string {
+	formats := make([]string, 0, len(exporters))
+	for format := range exporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Export writes all public mappings to w as short links, using opts
+func (db *DB) Export(w io.Writer, opts ExportOptions) error {
+	exporter, exists := exporters[opts.Format]
+	if !exists {
+		return fmt.Errorf("invalid export format %q", opts.Format)
+	}
+
+	entries, err := db.ListWithOptions(ListOptions{Visibility: ListPublic})
+	if err != nil {
+		return err
+	}
+
+	return exporter(w, db, entries)
+}
+
+// ShortUrl returns the short link url for code
+func (db *DB) ShortUrl(code string) string {
+	if code == indexCode {
+		return "https://" + db.Domain + "/"
+	}
+	return "https://" + db.Domain + codePath(code)
+}
+
+// exportUpdated returns the last updated time for an export of entries,
+// which is the latest entry created time, or else the database mtime
+func exportUpdated(db *DB, entries []Entry) time.Time {
+	var updated time.Time
+	for _, entry := range entries {
+		if entry.Created.After(updated) {
+			updated = entry.Created
+		}
+	}
+	if updated.IsZero() {
+		if stat, err := os.Stat(db.DBPath); err == nil {
+			updated = stat.ModTime()
+		}
+	}
+	return updated.UTC()
+}
+
+// exportTitle returns the display title for entry
+func exportTitle(entry Entry) string {
+	if entry.Title != "" {
+		return entry.Title
+	}
+	return entry.Code
+}
+
+var directoryTemplate = template.Must(template.New("directory").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Domain }} links</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+input { font-size: 1em; padding: 0.3em; width: 20em; margin-bottom: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { cursor: pointer; user-select: none; background: #f4f4f4; }
+th.asc::after { content: " \25b2"; }
+th.desc::after { content: " \25bc"; }
+td.url { word-break: break-all; color: #666; }
+.tag { display: inline-block; background: #eef; border-radius: 3px; padding: 0 0.3em; margin: 0 0.2em 0.2em 0; }
+</style>
+</head>
+<body>
+<h1>{{ .Domain }} links</h1>
+<input id="search" type="search" placeholder="Search links..." autofocus>
+<table id="links">
+<thead>
+<tr><th>Code</th><th>Title</th><th>Url</th><th>Tags</th><th>Created</th></tr>
+</thead>
+<tbody>
+{{- range .Entries }}
+<tr><td><a href="{{ .ShortUrl }}">{{ .Code }}</a></td><td>{{ .Title }}</td><td class="url">{{ .Url }}</td><td>{{ range .Tags }}<span class="tag">{{ . }}</span>{{ end }}</td><td>{{ .Created }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+<script>
+(function () {
+  var table = document.getElementById("links");
+  var tbody = table.tBodies[0];
+  document.getElementById("search").addEventListener("input", function () {
+    var terms = this.value.toLowerCase().split(/\s+/).filter(Boolean);
+    Array.prototype.forEach.call(tbody.rows, function (row) {
+      var text = row.textContent.toLowerCase();
+      row.hidden = !terms.every(function (term) { return text.indexOf(term) >= 0; });
+    });
+  });
+  Array.prototype.forEach.call(table.tHead.rows[0].cells, function (th, col) {
+    th.addEventListener("click", function () {
+      var desc = th.classList.contains("asc");
+      Array.prototype.forEach.call(th.parentNode.cells, function (c) { c.className = ""; });
+      th.className = desc ? "desc" : "asc";
+      var rows = Array.prototype.slice.call(tbody.rows);
+      rows.sort(function (a, b) {
+        var x = a.cells[col].textContent.toLowerCase(), y = b.cells[col].textContent.toLowerCase();
+        return (x < y ? -1 : x > y ? 1 : 0) * (desc ? -1 : 1);
+      });
+      rows.forEach(function (row) { tbody.appendChild(row); });
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+// directoryEntry is an entry as rendered by directoryTemplate
+type directoryEntry struct {
+	Code     string
+	ShortUrl string
+	Title    string
+	Url      string
+	Tags     []string
+	Created  string
+}
+
+// exportHTML writes entries to w as a standalone HTML link directory,
+// sortable by column and searchable, with no external assets
+func exportHTML(w io.Writer, db *DB, entries []Entry) error {
+	data := struct {
+		Domain  string
+		Entries []directoryEntry
+	}{Domain: db.Domain}
+	for _, entry := range entries {
+		de := directoryEntry{
+			Code:     entry.Code,
+			ShortUrl: db.ShortUrl(entry.Code),
+			Title:    entry.Title,
+			Url:      entry.Url,
+			Tags:     entry.Tags,
+		}
+		if !entry.Created.IsZero() {
+			de.Created = entry.Created.UTC().Format("2006-01-02")
+		}
+		data.Entries = append(data.Entries, de)
+	}
+	return directoryTemplate.Execute(w, data)
+}
+
+// markdownEscaper escapes text for use in Markdown table cells
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, `|`, `\|`, `[`, `\[`, `]`, `\]`, `*`, `\*`, `_`, `\_`, "`", "\\`",
+	"&", "&amp;", "<", "&lt;", "\n", " ", "\r", "",
+)
+
+// exportMarkdown writes entries to w as a Markdown table
+func exportMarkdown(w io.Writer, db *DB, entries []Entry) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s links\n\n", markdownEscaper.Replace(db.Domain))
+	b.WriteString("| Code | Title | Url | Tags |\n")
+	b.WriteString("| --- | --- | --- | --- |\n")
+	for _, entry := range entries {
+		tags := make([]string, len(entry.Tags))
+		for i, tag := range entry.Tags {
+			tags[i] = markdownEscaper.Replace(tag)
+		}
+		fmt.Fprintf(&b, "| [%s](<%s>) | %s | <%s> | %s |\n",
+			markdownEscaper.Replace(entry.Code), db.ShortUrl(entry.Code),
+			markdownEscaper.Replace(entry.Title),
+			strings.NewReplacer(">", "%3E", "|", "%7C", " ", "%20").Replace(entry.Url),
+			strings.Join(tags, ", "))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// atomFeed is an Atom feed, per RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Updated    string         `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary"`
+}
+
+// exportAtom writes entries to w as an Atom feed, newest first. Entries
+// without a created time are treated as being as old as the feed (the
+// database modification time, if no entries have created times).
+func exportAtom(w io.Writer, db *DB, entries []Entry) error {
+	updated := exportUpdated(db, entries)
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+
+	feed := atomFeed{
+		Title:   db.Domain + " links",
+		ID:      db.ShortUrl(indexCode),
+		Link:    atomLink{Href: db.ShortUrl(indexCode)},
+		Updated: updated.Format(time.RFC3339),
+		Author:  atomAuthor{Name: db.Domain},
+	}
+	for _, entry := range sorted {
+		entryUpdated := updated
+		if !entry.Created.IsZero() {
+			entryUpdated = entry.Created.UTC()
+		}
+		ae := atomEntry{
+			Title: exportTitle(entry),
+			ID:    db.ShortUrl(entry.Code),
+			Links: []atomLink{
+				{Href: db.ShortUrl(entry.Code)},
+				{Href: entry.Url, Rel: "related"},
+			},
+			Updated: entryUpdated.Format(time.RFC3339),
+			Summary: entry.Url,
+		}
+		for _, tag := range entry.Tags {
+			ae.Categories = append(ae.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, ae)
+	}
+
+	return writeXML(w, feed)
+}
+
+// opmlDoc is an OPML 2.0 document
+type opmlDoc struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Version  string        `xml:"version,attr"`
+	Title    string        `xml:"head>title"`
+	Modified string        `xml:"head>dateModified"`
+	Outlines []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string `xml:"text,attr"`
+	Type     string `xml:"type,attr"`
+	Url      string `xml:"url,attr"`
+	Category string `xml:"category,attr,omitempty"`
+	Created  string `xml:"created,attr,omitempty"`
+}
+
+// exportOPML writes entries to w as an OPML outline of link outlines
+func exportOPML(w io.Writer, db *DB, entries []Entry) error {
+	doc := opmlDoc{
+		Version:  "2.0",
+		Title:    db.Domain + " links",
+		Modified: exportUpdated(db, entries).Format(time.RFC1123Z),
+	}
+	for _, entry := range entries {
+		outline := opmlOutline{
+			Text:     exportTitle(entry),
+			Type:     "link",
+			Url:      db.ShortUrl(entry.Code),
+			Category: strings.Join(entry.Tags, ","),
+		}
+		if !entry.Created.IsZero() {
+			outline.Created = entry.Created.UTC().Format(time.RFC1123Z)
+		}
+		doc.Outlines = append(doc.Outlines, outline)
+	}
+
+	return writeXML(w, doc)
+}
+
+// writeXML writes v to w as an indented XML document
+func writeXML(w io.Writer, v interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,172 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for reverse lookups of mappings by
+destination url or host.
+
+Lookups are backed by a reverse index of normalised urls and hosts to
+codes, cached in the usher root (`.$DOMAIN.index`), which is rebuilt
+automatically whenever the database has changed since the index was
+written. Entries are only read from the database for matching codes.
+*/
+
+package usher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FindMode determines how FindByURL matches urls
+type FindMode int
+
+const (
+	FindExact  FindMode = iota // url matches exactly (in normalised form)
+	FindPrefix                 // url starts with the given prefix (in normalised form)
+	FindHost                   // url host matches (a leading dot also matches subdomains)
+)
+
+// reverseIndex maps normalised urls and hosts back to codes
+type reverseIndex struct {
+	DBModTime int64               `json:"db_mtime"`
+	DBSize    int64               `json:"db_size"`
+	Urls      map[string][]string `json:"urls"`  // urlKey => codes
+	Keys      []string            `json:"keys"`  // sorted urlKeys, for prefix searches
+	Hosts     map[string][]string `json:"hosts"` // normalised host => codes
+}
+
+// FindByURL returns the entries whose urls match query using mode,
+// sorted by code
+func (db *DB) FindByURL(query string, mode FindMode) ([]Entry, error) {
+	return db.FindByURLWithOptions(query, mode, ListOptions{})
+}
+
+// FindByURLWithOptions returns the entries whose urls match query using
+// mode, and which pass the filters in opts (as for ListWithOptions),
+// sorted by code
+func (db *DB) FindByURLWithOptions(query string, mode FindMode, opts ListOptions) ([]Entry, error) {
+	index, mappings, err := db.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	switch mode {
+	case FindExact:
+		codes = append(codes, index.Urls[urlKey(query)]...)
+
+	case FindPrefix:
+		// urlKey gives bare hosts a "/" path, so prefixes always match
+		// whole hosts
+		prefix := urlKey(query)
+		i := sort.SearchStrings(index.Keys, prefix)
+		for ; i < len(index.Keys) && strings.HasPrefix(index.Keys[i], prefix); i++ {
+			codes = append(codes, index.Urls[index.Keys[i]]...)
+		}
+
+	case FindHost:
+		if strings.HasPrefix(query, ".") {
+			suffix := normaliseHost(query[1:])
+			for host, hostCodes := range index.Hosts {
+				if host == suffix || strings.HasSuffix(host, "."+suffix) {
+					codes = append(codes, hostCodes...)
+				}
+			}
+		} else {
+			codes = append(codes, index.Hosts[normaliseHost(query)]...)
+		}
+	}
+
+	if len(codes) == 0 {
+		return []Entry{}, nil
+	}
+	if mappings == nil {
+		mappings, err = db.readDB()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(codes)
+	entries := make([]Entry, 0, len(codes))
+	for _, code := range codes {
+		if entry, exists := mappings[code]; exists && opts.includes(entry) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// indexPath returns the path of the reverse index file for db.Domain
+func (db *DB) indexPath() string {
+	return filepath.Join(db.Root, "."+db.Domain+".index")
+}
+
+// readIndex is a utility function to return the reverse index for
+// db.Domain, rebuilding it if missing or stale. If the index was
+// rebuilt, the database mappings read are also returned.
+func (db *DB) readIndex() (*reverseIndex, map[string]*Entry, error) {
+	stat, err := os.Stat(db.DBPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Use the cached index if it's current. Any error here just
+	// means we rebuild.
+	data, err := ioutil.ReadFile(db.indexPath())
+	if err == nil {
+		var index reverseIndex
+		err = json.Unmarshal(data, &index)
+		if err == nil &&
+			index.DBModTime == stat.ModTime().UnixNano() &&
+			index.DBSize == stat.Size() {
+			return &index, nil, nil
+		}
+	}
+
+	return db.buildIndex(stat)
+}
+
+// buildIndex is a utility function to rebuild and cache the reverse
+// index for db.Domain, returning it and the database mappings. Failure
+// to write the cache is not an error.
+func (db *DB) buildIndex(stat os.FileInfo) (*reverseIndex, map[string]*Entry, error) {
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := &reverseIndex{
+		DBModTime: stat.ModTime().UnixNano(),
+		DBSize:    stat.Size(),
+		Urls:      make(map[string][]string),
+		Hosts:     make(map[string][]string),
+	}
+	for code, entry := range mappings {
+		url := entry.Url
+		key := urlKey(url)
+		if _, exists := index.Urls[key]; !exists {
+			index.Keys = append(index.Keys, key)
+		}
+		index.Urls[key] = append(index.Urls[key], code)
+		if host := urlHost(url); host != "" {
+			index.Hosts[host] = append(index.Hosts[host], code)
+		}
+	}
+	sort.Strings(index.Keys)
+
+	data, err := json.Marshal(index)
+	if err == nil {
+		tmpfile := db.indexPath() + ".tmp"
+		err = ioutil.WriteFile(tmpfile, data, 0644)
+		if err == nil {
+			os.Rename(tmpfile, db.indexPath())
+		}
+	}
+
+	return index, mappings, nil
+}
@@ -4,10 +4,12 @@ go 1.13
 
 require (
 	github.com/alecthomas/kong v0.2.11
-	github.com/aws/aws-sdk-go v1.35.14
+	github.com/aws/aws-sdk-go v1.37.0
 	github.com/magiconair/properties v1.8.4
 	github.com/stretchr/testify v1.2.2
 	github.com/udhos/equalfile v0.3.0
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
+	golang.org/x/text v0.3.3
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 )
@@ -0,0 +1,112 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for checking url destination hosts
+against the `allow_hosts` and `deny_hosts` policies configured for
+a domain.
+
+Host patterns may be:
+- an exact hostname e.g. `example.com`
+- a suffix, with a leading dot e.g. `.example.com`, which matches
+  example.com itself and all its subdomains
+- a glob e.g. `*.example.com` or `docs-?.example.com`
+*/
+
+package usher
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// checkHost checks the host of rawurl against the host policies in
+// config. Errors returned wrap ErrHostDenied, and name the rule matched.
+func (config *ConfigEntry) checkHost(rawurl string) error {
+	if len(config.AllowHosts) == 0 && len(config.DenyHosts) == 0 {
+		return nil
+	}
+
+	host := urlHost(rawurl)
+	if host == "" {
+		return fmt.Errorf("url %q has no host to check against host policies: %w",
+			rawurl, ErrHostDenied)
+	}
+
+	// Deny rules take precedence
+	for _, pattern := range config.DenyHosts {
+		if matchHost(pattern, host) {
+			return fmt.Errorf("host %q denied by deny_hosts rule %q: %w",
+				host, pattern, ErrHostDenied)
+		}
+	}
+
+	if len(config.AllowHosts) == 0 {
+		return nil
+	}
+	for _, pattern := range config.AllowHosts {
+		if matchHost(pattern, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q not matched by any allow_hosts rule (%s): %w",
+		host, strings.Join(config.AllowHosts, ", "), ErrHostDenied)
+}
+
+// checkHosts checks the urls of all mappings against the host policies
+// in config, returning an error listing all codes that fail
+func (config *ConfigEntry) checkHosts(mappings map[string]string) error {
+	var failures []string
+	for code, url := range mappings {
+		err := config.checkHost(url)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", code, err))
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+
+	sort.Strings(failures)
+	return fmt.Errorf("%d mapping(s) fail host policy checks:\n  %s\n%w",
+		len(failures), strings.Join(failures, "\n  "), ErrHostDenied)
+}
+
+// urlHost returns the normalised (lowercased, punycoded) hostname
+// for rawurl, or an empty string if none can be determined
+func urlHost(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return normaliseHost(u.Hostname())
+}
+
+// normaliseHost returns host lowercased and converted to punycode,
+// without any trailing dot
+func normaliseHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// matchHost returns true if (normalised) host matches pattern
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	switch {
+	case strings.ContainsAny(pattern, "*?["):
+		matched, _ := path.Match(pattern, host)
+		return matched
+	case strings.HasPrefix(pattern, "."):
+		suffix := normaliseHost(pattern[1:])
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	default:
+		return host == normaliseHost(pattern)
+	}
+}
@@ -0,0 +1,507 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for importing mappings from CSV, TSV,
+JSON and YAML files. Exports from other url shorteners are handled
+by the adapters in importers.go, and browser bookmark files in
+bookmarks.go.
+
+Tabular (CSV/TSV) files may have a header row naming their columns,
+or else are assumed to have `code, url, title, tags` columns in that
+order. JSON and YAML files may contain either a list of objects, or
+a map of `code: url` or `code: { url: ..., title: ... }` entries (i.e.
+the usher database format). Source columns/keys are mapped to usher
+fields using ImportOptions.Columns, or else by common names (e.g.
+`url`, `long_url`, `target` for urls).
+*/
+
+package usher
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Import formats
+const (
+	FormatCSV  = "csv"
+	FormatTSV  = "tsv"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// Import conflict policies, for codes that already exist with a different url
+const (
+	ConflictFail      = "fail"      // abort the import, making no changes
+	ConflictSkip      = "skip"      // keep the existing mapping
+	ConflictOverwrite = "overwrite" // replace the existing mapping
+	ConflictRename    = "rename"    // import using a new code with a numeric suffix
+)
+
+// importFields are the usher fields that can be imported, with the
+// (lowercase) source column names recognised for each by default
+var importFields = map[string][]string{
+	"code":  {"code", "short", "shortcode", "short_code", "keyword", "slug", "alias"},
+	"url":   {"url", "long_url", "long url", "longurl", "original_url", "original url", "target", "destination", "link", "href"},
+	"title": {"title", "name", "description"},
+	"tags":  {"tags", "tag", "labels", "keywords"},
+}
+
+// importFieldOrder is the default column order for headerless tabular files
+var importFieldOrder = []string{"code", "url", "title", "tags"}
+
+var reTagSeparators = regexp.MustCompile(`\s*[,;|]\s*`)
+
+var errDryRun = errors.New("dry run")
+
+// ImportOptions are settings for importing mappings
+type ImportOptions struct {
+	Format     string            // import format, or "" to detect from filename and content
+	Columns    map[string]string // usher field => source column name (or 1-based index)
+	OnConflict string            // conflict policy (default: ConflictFail)
+	DryRun     bool              // report what would be imported without changing anything
+	Force      bool              // skip url validation and normalisation
+}
+
+// ImportRecord is a single entry to be imported, with the row (or
+// item) number it was found at in the source
+type ImportRecord struct {
+	Row int
+	Entry
+}
+
+// ImportError records an import record that could not be imported
+type ImportError struct {
+	Row int
+	Err error
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Err)
+}
+
+// ImportSummary reports the results of an import
+type ImportSummary struct {
+	Added       int
+	Overwritten int
+	Renamed     int
+	Skipped     int
+	Unchanged   int
+	Invalid     []ImportError
+	Renames     []ImportRename // renamed records, in import order
+}
+
+// ImportRename records a record imported with a new code, because its
+// original code was already used
+type ImportRename struct {
+	Original string
+	New      string
+}
+
+// DetectImportFormat returns the import format for a file with name
+// path and contents data. A known file extension determines the format,
+// except that CSV and JSON exports from other shorteners are detected
+// by their schema. Files with other extensions are detected by content.
+func DetectImportFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		if format := detectShortenerCSV(data); format != "" {
+			return format
+		}
+		return FormatCSV
+	case ".tsv", ".tab":
+		return FormatTSV
+	case ".json":
+		if format := detectShortenerJSON(data); format != "" {
+			return format
+		}
+		return FormatJSON
+	case ".yml", ".yaml":
+		return FormatYAML
+	case ".html", ".htm":
+		return FormatBookmarks
+	case ".sql":
+		return FormatYOURLS
+	}
+
+	if format := detectShortenerFormat(data); format != "" {
+		return format
+	}
+	if isBookmarks(data) {
+		return FormatBookmarks
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return FormatYAML
+	}
+	if data[0] == '[' || data[0] == '{' {
+		return FormatJSON
+	}
+	firstLine := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		firstLine = data[:i]
+	}
+	switch {
+	case bytes.IndexByte(firstLine, '\t') >= 0:
+		return FormatTSV
+	case bytes.HasPrefix(firstLine, []byte("- ")) || bytes.Contains(firstLine, []byte(": ")):
+		return FormatYAML
+	case bytes.IndexByte(firstLine, ',') >= 0:
+		return FormatCSV
+	}
+	return FormatYAML
+}
+
+// ParseImport parses data in format into import records, mapping
+// source columns to usher fields using columns (which may be nil)
+func ParseImport(data []byte, format string, columns map[string]string) ([]ImportRecord, error) {
+	for field := range columns {
+		if _, exists := importFields[field]; !exists {
+			return nil, fmt.Errorf("invalid import field %q (valid fields: code, url, title, tags)", field)
+		}
+	}
+
+	switch format {
+	case FormatCSV:
+		return parseImportTable(data, ',', columns)
+	case FormatTSV:
+		return parseImportTable(data, '\t', columns)
+	case FormatJSON, FormatYAML:
+		// YAML is a superset of JSON, so we can use the yaml parser for both
+		var doc interface{}
+		err := yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", format, err)
+		}
+		return parseImportDoc(doc, columns)
+	default:
+		if adapter, exists := importAdapters[format]; exists {
+			return adapter(data)
+		}
+		return nil, fmt.Errorf("invalid import format %q", format)
+	}
+}
+
+// parseImportTable parses delimited tabular data into import records
+func parseImportTable(data []byte, delim rune, columns map[string]string) ([]ImportRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = delim
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	// Map usher fields to column indexes, checking for a header row
+	header := make(map[string]int)
+	for i, name := range rows[0] {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	indexes := make(map[string]int)
+	hasHeader := false
+	for field, aliases := range importFields {
+		if col, exists := columns[field]; exists {
+			if n, err := strconv.Atoi(col); err == nil && n > 0 {
+				indexes[field] = n - 1
+				continue
+			}
+			i, exists := header[strings.ToLower(col)]
+			if !exists {
+				return nil, fmt.Errorf("import column %q for field %q not found in header", col, field)
+			}
+			indexes[field] = i
+			hasHeader = true
+			continue
+		}
+		for _, alias := range aliases {
+			if i, exists := header[alias]; exists {
+				indexes[field] = i
+				hasHeader = true
+				break
+			}
+		}
+	}
+	if hasHeader {
+		rows = rows[1:]
+	} else {
+		for i, field := range importFieldOrder {
+			if _, exists := indexes[field]; !exists {
+				indexes[field] = i
+			}
+		}
+	}
+	if _, exists := indexes["url"]; !exists {
+		return nil, errors.New("no url column found in import header")
+	}
+
+	// Build records
+	var records []ImportRecord
+	rowOffset := 1
+	if hasHeader {
+		rowOffset = 2
+	}
+	for r, row := range rows {
+		cell := func(field string) string {
+			i, exists := indexes[field]
+			if !exists || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		if strings.Join(row, "") == "" {
+			continue
+		}
+		records = append(records, ImportRecord{Row: r + rowOffset, Entry: Entry{
+			Code:  cell("code"),
+			Url:   cell("url"),
+			Title: cell("title"),
+			Tags:  splitTags(cell("tags")),
+		}})
+	}
+
+	return records, nil
+}
+
+// parseImportDoc parses a decoded JSON/YAML document into import records
+func parseImportDoc(doc interface{}, columns map[string]string) ([]ImportRecord, error) {
+	// yaml decodes maps with non-string keys (e.g. numeric codes) as
+	// map[interface{}]interface{}, so normalise those first
+	if m, ok := doc.(map[interface{}]interface{}); ok {
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			sm[fmt.Sprint(k)] = v
+		}
+		doc = sm
+	}
+
+	var records []ImportRecord
+	switch d := doc.(type) {
+	case nil:
+		return nil, nil
+
+	// List of objects
+	case []interface{}:
+		for i, item := range d {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("item %d is not an object", i+1)
+			}
+			records = append(records, ImportRecord{Row: i + 1, Entry: importObject(obj, columns)})
+		}
+
+	// Map of code => url or code => object
+	case map[string]interface{}:
+		codes := make([]string, 0, len(d))
+		for code := range d {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for i, code := range codes {
+			var entry Entry
+			switch v := d[code].(type) {
+			case string:
+				entry.Url = v
+			case map[string]interface{}:
+				entry = importObject(v, columns)
+			default:
+				return nil, fmt.Errorf("invalid value for code %q", code)
+			}
+			if entry.Code == "" {
+				entry.Code = code
+			}
+			records = append(records, ImportRecord{Row: i + 1, Entry: entry})
+		}
+
+	default:
+		return nil, errors.New("import data must be a list or map")
+	}
+
+	return records, nil
+}
+
+// importObject maps the keys of a JSON/YAML object to entry fields
+func importObject(obj map[string]interface{}, columns map[string]string) Entry {
+	lower := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		lower[strings.ToLower(k)] = v
+	}
+	value := func(field string) interface{} {
+		if col, exists := columns[field]; exists {
+			return lower[strings.ToLower(col)]
+		}
+		for _, alias := range importFields[field] {
+			if v, exists := lower[alias]; exists {
+				return v
+			}
+		}
+		return nil
+	}
+	str := func(field string) string {
+		switch v := value(field).(type) {
+		case nil:
+			return ""
+		case string:
+			return strings.TrimSpace(v)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	entry := Entry{Code: str("code"), Url: str("url"), Title: str("title")}
+	switch tags := value("tags").(type) {
+	case string:
+		entry.Tags = splitTags(tags)
+	case []interface{}:
+		for _, tag := range tags {
+			if s := strings.TrimSpace(fmt.Sprint(tag)); s != "" {
+				entry.Tags = append(entry.Tags, s)
+			}
+		}
+	}
+	return entry
+}
+
+// splitTags splits a string of tags separated by commas, semicolons or pipes
+func splitTags(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	var tags []string
+	for _, tag := range reTagSeparators.Split(s, -1) {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// ImportFile imports mappings from the file at path, using opts
+func (db *DB) ImportFile(path string, opts ImportOptions) (*ImportSummary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = DetectImportFormat(path, data)
+	}
+	records, err := ParseImport(data, format, opts.Columns)
+	if err != nil {
+		return nil, fmt.Errorf("importing %q: %w", path, err)
+	}
+
+	return db.Import(records, opts)
+}
+
+// Import imports records into the database in a single batch, using
+// opts. Records that fail validation are skipped and reported in the
+// summary. Conflicts (codes that already exist with a different url)
+// are handled according to opts.OnConflict - with ConflictFail, the
+// first conflict aborts the import and an error is returned.
+func (db *DB) Import(records []ImportRecord, opts ImportOptions) (*ImportSummary, error) {
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = ConflictFail
+	case ConflictFail, ConflictSkip, ConflictOverwrite, ConflictRename:
+	default:
+		return nil, fmt.Errorf("invalid conflict policy %q", opts.OnConflict)
+	}
+
+	summary := &ImportSummary{}
+	err := db.Batch(func(tx *Tx) error {
+		for _, record := range records {
+			err := tx.importEntry(record.Entry, opts, summary)
+			if err != nil {
+				if errors.Is(err, ErrCodeExists) {
+					return fmt.Errorf("row %d: %w", record.Row, err)
+				}
+				summary.Invalid = append(summary.Invalid, ImportError{Row: record.Row, Err: err})
+			}
+		}
+		if opts.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// importEntry imports entry within tx, according to opts, recording
+// the result in summary
+func (tx *Tx) importEntry(entry Entry, opts ImportOptions, summary *ImportSummary) error {
+	if entry.Url == "" {
+		return errors.New("missing url")
+	}
+	url, code := uninvert(entry.Url, entry.Code)
+	addOpts := AddOptions{Force: opts.Force, Title: entry.Title, Tags: entry.Tags,
+		Private: entry.Private, Created: entry.Created, Clicks: entry.Clicks}
+
+	// Records without codes reuse any existing code for url, or get a random one
+	code, existing, err := tx.Add(url, code, addOpts)
+	switch {
+	case err == nil && existing:
+		summary.Unchanged++
+		return nil
+	case err == nil:
+		summary.Added++
+		return nil
+	case err != ErrCodeExists:
+		return err
+	}
+
+	// code exists with a different url
+	switch opts.OnConflict {
+	case ConflictSkip:
+		summary.Skipped++
+	case ConflictOverwrite:
+		err = tx.Remove(code)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Add(url, code, addOpts)
+		if err != nil {
+			return err
+		}
+		summary.Overwritten++
+	case ConflictRename:
+		newCode := code
+		for i := 2; ; i++ {
+			newCode = fmt.Sprintf("%s-%d", code, i)
+			if _, exists := tx.mappings[newCode]; !exists {
+				break
+			}
+		}
+		_, _, err = tx.Add(url, newCode, addOpts)
+		if err != nil {
+			return err
+		}
+		summary.Renames = append(summary.Renames, ImportRename{Original: code, New: newCode})
+		summary.Renamed++
+	default:
+		return fmt.Errorf("code %q exists with url %q: %w", code, tx.mappings[code].Url, ErrCodeExists)
+	}
+
+	return nil
+}
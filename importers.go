@@ -0,0 +1,468 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains import adapters for the export formats of other
+url shorteners, which parse exports offline into usher entries,
+keeping titles, tags, created dates and click counts where the
+source schema has them:
+
+- yourls: a mysqldump of the YOURLS `yourls_url` table
+- shlink: a Shlink short url export, either the web client CSV or
+  the REST API `short-urls` JSON
+- bitly: a Bitly link export CSV
+- kutt: the Kutt REST API `links` JSON
+*/
+
+package usher
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shortener import formats
+const (
+	FormatYOURLS = "yourls"
+	FormatShlink = "shlink"
+	FormatBitly  = "bitly"
+	FormatKutt   = "kutt"
+)
+
+// importAdapters are the parsers for shortener (and bookmark) import formats
+var importAdapters = map[string]func(data []byte) ([]ImportRecord, error){
+	FormatYOURLS: parseYOURLS,
+	FormatShlink: parseShlink,
+	FormatBitly:  parseBitly,
+	FormatKutt:   parseKutt,
+
+	FormatBookmarks: parseBookmarks,
+}
+
+// importTimeLayouts are the timestamp layouts we accept in imports
+var importTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+var reYOURLSInsert = regexp.MustCompile("(?i)INSERT\\s+INTO\\s+`?\\w*yourls_url`?\\s*(\\(([^)]*)\\))?\\s*VALUES\\s*")
+
+// yourlsColumns is the default column order of the yourls_url table
+var yourlsColumns = []string{"keyword", "url", "title", "timestamp", "ip", "clicks"}
+
+// detectShortenerFormat returns the shortener import format that data
+// looks like, or an empty string. Exports are matched by their schema:
+// YOURLS dumps by their table inserts, JSON exports by their top-level
+// structure, and CSV exports by their header columns.
+func detectShortenerFormat(data []byte) string {
+	if reYOURLSInsert.Match(data) {
+		return FormatYOURLS
+	}
+	if format := detectShortenerJSON(data); format != "" {
+		return format
+	}
+	return detectShortenerCSV(data)
+}
+
+// detectShortenerJSON returns the shortener import format of JSON data,
+// or an empty string. Shlink exports are objects with a `shortUrls`
+// object containing a `data` array, and Kutt exports are objects with
+// a `data` array of links, each with an `address` and a `target`.
+func detectShortenerJSON(data []byte) string {
+	var export struct {
+		ShortUrls *struct {
+			Data []json.RawMessage `json:"data"`
+		} `json:"shortUrls"`
+		Data []map[string]json.RawMessage `json:"data"`
+	}
+	err := json.Unmarshal(data, &export)
+	if err != nil {
+		return ""
+	}
+
+	if export.ShortUrls != nil && export.ShortUrls.Data != nil {
+		return FormatShlink
+	}
+	if len(export.Data) == 0 {
+		return ""
+	}
+	for _, link := range export.Data {
+		_, hasAddress := link["address"]
+		_, hasTarget := link["target"]
+		if !hasAddress || !hasTarget {
+			return ""
+		}
+	}
+	return FormatKutt
+}
+
+// detectShortenerCSV returns the shortener import format of CSV data,
+// or an empty string, matching exact (lowercase) header column names
+func detectShortenerCSV(data []byte) string {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	row, err := reader.Read()
+	if err != nil {
+		return ""
+	}
+
+	header := make(map[string]bool)
+	for _, name := range row {
+		name = strings.TrimPrefix(name, "\ufeff")
+		header[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case header["bitlink"]:
+		return FormatBitly
+	case header["shortcode"] && header["longurl"]:
+		return FormatShlink
+	}
+	return ""
+}
+
+// parseImportTime parses s using any of importTimeLayouts, returning
+// a zero time if none match
+func parseImportTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseImportInt parses s as an integer, returning 0 on error
+func parseImportInt(s string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
+// parseYOURLS parses yourls_url INSERT statements from a mysqldump
+func parseYOURLS(data []byte) ([]ImportRecord, error) {
+	var records []ImportRecord
+	sql := string(data)
+	locs := reYOURLSInsert.FindAllStringSubmatchIndex(sql, -1)
+	if len(locs) == 0 {
+		return nil, errors.New("no yourls_url INSERT statements found")
+	}
+
+	for _, loc := range locs {
+		// Use explicit column names if present
+		columns := yourlsColumns
+		if loc[4] >= 0 {
+			columns = nil
+			for _, col := range strings.Split(sql[loc[4]:loc[5]], ",") {
+				columns = append(columns, strings.Trim(strings.TrimSpace(col), "`"))
+			}
+		}
+
+		tuples, err := parseSQLTuples(sql[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		for _, tuple := range tuples {
+			row := make(map[string]string)
+			for i, value := range tuple {
+				if i < len(columns) {
+					row[strings.ToLower(columns[i])] = value
+				}
+			}
+			records = append(records, ImportRecord{Row: len(records) + 1, Entry: Entry{
+				Code:    row["keyword"],
+				Url:     row["url"],
+				Title:   row["title"],
+				Created: parseImportTime(row["timestamp"]),
+				Clicks:  parseImportInt(row["clicks"]),
+			}})
+		}
+	}
+
+	return records, nil
+}
+
+// parseSQLTuples parses the `(...),(...);` value tuples of an SQL
+// INSERT statement, stopping at the terminating semicolon
+func parseSQLTuples(sql string) ([][]string, error) {
+	var tuples [][]string
+	var tuple []string
+	var value strings.Builder
+	inTuple, inString, quoted := false, false, false
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case inString:
+			switch {
+			case c == '\\' && i+1 < len(sql):
+				i++
+				switch sql[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 'r':
+					value.WriteByte('\r')
+				case 't':
+					value.WriteByte('\t')
+				case '0':
+					value.WriteByte(0)
+				default:
+					value.WriteByte(sql[i])
+				}
+			case c == '\'' && i+1 < len(sql) && sql[i+1] == '\'':
+				value.WriteByte('\'')
+				i++
+			case c == '\'':
+				inString = false
+			default:
+				value.WriteByte(c)
+			}
+
+		case !inTuple:
+			switch c {
+			case '(':
+				inTuple = true
+				tuple = nil
+			case ';':
+				return tuples, nil
+			}
+
+		case c == '\'':
+			inString, quoted = true, true
+
+		case c == ',' || c == ')':
+			v := value.String()
+			if !quoted {
+				v = strings.TrimSpace(v)
+				if strings.EqualFold(v, "NULL") {
+					v = ""
+				}
+			}
+			tuple = append(tuple, v)
+			value.Reset()
+			quoted = false
+			if c == ')' {
+				tuples = append(tuples, tuple)
+				inTuple = false
+			}
+
+		default:
+			if !quoted {
+				value.WriteByte(c)
+			}
+		}
+	}
+
+	if inTuple || inString {
+		return nil, errors.New("unterminated SQL INSERT statement")
+	}
+	return tuples, nil
+}
+
+// shlinkShortUrl is a short url in the Shlink REST API format
+type shlinkShortUrl struct {
+	ShortCode     string `json:"shortCode"`
+	LongUrl       string `json:"longUrl"`
+	DateCreated   string `json:"dateCreated"`
+	VisitsCount   int    `json:"visitsCount"`
+	VisitsSummary *struct {
+		Total int `json:"total"`
+	} `json:"visitsSummary"`
+	Tags  []string `json:"tags"`
+	Title string   `json:"title"`
+}
+
+// parseShlink parses a Shlink export, as REST API JSON or web client CSV
+func parseShlink(data []byte) ([]ImportRecord, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return parseShortenerCSV(data, map[string][]string{
+			"code":    {"shortcode"},
+			"url":     {"longurl"},
+			"title":   {"title"},
+			"tags":    {"tags"},
+			"created": {"createdat", "datecreated"},
+			"clicks":  {"visits", "visitscount"},
+		})
+	}
+
+	var shortUrls []shlinkShortUrl
+	if trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &shortUrls)
+		if err != nil {
+			return nil, fmt.Errorf("parsing shlink json: %w", err)
+		}
+	} else {
+		var export struct {
+			ShortUrls struct {
+				Data []shlinkShortUrl `json:"data"`
+			} `json:"shortUrls"`
+		}
+		err := json.Unmarshal(trimmed, &export)
+		if err != nil {
+			return nil, fmt.Errorf("parsing shlink json: %w", err)
+		}
+		shortUrls = export.ShortUrls.Data
+	}
+
+	records := make([]ImportRecord, len(shortUrls))
+	for i, s := range shortUrls {
+		clicks := s.VisitsCount
+		if s.VisitsSummary != nil {
+			clicks = s.VisitsSummary.Total
+		}
+		records[i] = ImportRecord{Row: i + 1, Entry: Entry{
+			Code:    s.ShortCode,
+			Url:     s.LongUrl,
+			Title:   s.Title,
+			Tags:    s.Tags,
+			Created: parseImportTime(s.DateCreated),
+			Clicks:  clicks,
+		}}
+	}
+	return records, nil
+}
+
+// parseBitly parses a Bitly link export CSV
+func parseBitly(data []byte) ([]ImportRecord, error) {
+	records, err := parseShortenerCSV(data, map[string][]string{
+		"code":    {"custom bitlink", "bitlink", "link"},
+		"url":     {"long url", "long_url", "destination url"},
+		"title":   {"title"},
+		"tags":    {"tags"},
+		"created": {"created", "date created", "created at", "created_at"},
+		"clicks":  {"clicks", "total clicks", "engagements"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Bitly codes are bitlinks e.g. `bit.ly/abc123` - use the path
+	for i := range records {
+		records[i].Code = bitlinkCode(records[i].Code)
+	}
+	return records, nil
+}
+
+// bitlinkCode returns the code from a bitlink like `bit.ly/abc123`
+func bitlinkCode(bitlink string) string {
+	if bitlink == "" {
+		return ""
+	}
+	if !strings.Contains(bitlink, "://") {
+		bitlink = "https://" + bitlink
+	}
+	u, err := url.Parse(bitlink)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(u.Path, "/")
+}
+
+// kuttLink is a link in the Kutt REST API format
+type kuttLink struct {
+	Address     string `json:"address"`
+	Target      string `json:"target"`
+	Description string `json:"description"`
+	VisitCount  int    `json:"visit_count"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// parseKutt parses the Kutt REST API links JSON, either as the full
+// `{"data": [...]}` response or just the array of links
+func parseKutt(data []byte) ([]ImportRecord, error) {
+	trimmed := bytes.TrimSpace(data)
+	var links []kuttLink
+	var err error
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &links)
+	} else {
+		var export struct {
+			Data []kuttLink `json:"data"`
+		}
+		err = json.Unmarshal(trimmed, &export)
+		links = export.Data
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing kutt json: %w", err)
+	}
+
+	records := make([]ImportRecord, len(links))
+	for i, l := range links {
+		records[i] = ImportRecord{Row: i + 1, Entry: Entry{
+			Code:    l.Address,
+			Url:     l.Target,
+			Title:   l.Description,
+			Created: parseImportTime(l.CreatedAt),
+			Clicks:  l.VisitCount,
+		}}
+	}
+	return records, nil
+}
+
+// parseShortenerCSV parses a CSV export with a header row, mapping
+// entry fields to columns using the (lowercase) header names in fields,
+// in order of preference
+func parseShortenerCSV(data []byte, fields map[string][]string) ([]ImportRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := make(map[string]int)
+	for i, name := range rows[0] {
+		// Strip any byte order mark from the first column
+		name = strings.TrimPrefix(name, "\ufeff")
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	indexes := make(map[string][]int)
+	for field, names := range fields {
+		for _, name := range names {
+			if i, exists := header[name]; exists {
+				indexes[field] = append(indexes[field], i)
+			}
+		}
+	}
+	if _, exists := indexes["url"]; !exists {
+		return nil, errors.New("no url column found in header")
+	}
+
+	var records []ImportRecord
+	for r, row := range rows[1:] {
+		// Use the first non-empty column for field, in order of preference
+		cell := func(field string) string {
+			for _, i := range indexes[field] {
+				if i < len(row) && strings.TrimSpace(row[i]) != "" {
+					return strings.TrimSpace(row[i])
+				}
+			}
+			return ""
+		}
+		records = append(records, ImportRecord{Row: r + 2, Entry: Entry{
+			Code:    cell("code"),
+			Url:     cell("url"),
+			Title:   cell("title"),
+			Tags:    splitTags(cell("tags")),
+			Created: parseImportTime(cell("created")),
+			Clicks:  parseImportInt(cell("clicks")),
+		}})
+	}
+	return records, nil
+}
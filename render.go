@@ -22,9 +22,11 @@ package usher
 
 import (
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	yaml "gopkg.in/yaml.v3"
 )
@@ -51,33 +53,105 @@ type Config struct {
 	Services []Service `yaml:"services"`
 }
 
-// pushRender publishes our usher database mappings as a
+// renderBackend publishes mappings as routes in a render.yaml file
+type renderBackend struct {
+	db     *DB
+	config *ConfigEntry
+}
+
+func init() {
+	RegisterBackend("render", newRenderBackend)
+}
+
+// newRenderBackend returns a new render backend for db using config
+func newRenderBackend(db *DB, config *ConfigEntry) (Backend, error) {
+	return &renderBackend{db: db, config: config}, nil
+}
+
+// Validate checks the render backend options (there are none)
+func (b *renderBackend) Validate() error {
+	var options struct{}
+	return b.config.DecodeOptions(&options)
+}
+
+// Plan returns the changes a Push of mappings would make to render.yaml.
+// render.yaml is always rewritten in full, so opts.NoPrune is ignored.
+func (b *renderBackend) Plan(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	current, err := b.Pull()
+	if err != nil {
+		return nil, err
+	}
+	return diffMappings(current, mappings, true), nil
+}
+
+// Pull returns the mappings in the current render.yaml, if any
+func (b *renderBackend) Pull() (map[string]string, error) {
+	mappings := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(b.db.Root, configName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mappings, nil
+		}
+		return nil, err
+	}
+
+	var renderConfig Config
+	err = yaml.Unmarshal(data, &renderConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range renderConfig.Services {
+		if service.Name != b.db.Domain {
+			continue
+		}
+		for _, route := range service.Routes {
+			if route.Type != "redirect" {
+				continue
+			}
+			code := indexCode
+			if route.Source != "/" {
+				code, err = url.PathUnescape(strings.TrimPrefix(route.Source, "/"))
+				if err != nil {
+					return nil, err
+				}
+			}
+			mappings[code] = route.Destination
+		}
+	}
+
+	return mappings, nil
+}
+
+// Push publishes our usher database mappings as a
 // infrastructure config `render.yaml` file for render.com.
 // See https://render.com/docs/yaml-spec for the spec.
-func (db *DB) pushRender() error {
+func (b *renderBackend) Push(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	db := b.db
 	configfile := filepath.Join(db.Root, configName)
 
-	// Check timestamps on database vs. configfile
+	plan, err := b.Plan(mappings, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check timestamps on database and usher config vs. configfile
 	// This is an optimisation path, so we ignore errors
 	statCF, err := os.Stat(configfile)
-	if err == nil {
+	if err == nil && plan.Count(ActionUnchanged) == len(plan.Changes) {
 		statDB, err := os.Stat(db.DBPath)
 		if err == nil {
-			// If configfile is newer than database we can noop
-			if statCF.ModTime().After(statDB.ModTime()) {
-				return nil
+			statUC, err := os.Stat(db.ConfigPath)
+			// If configfile is newer than both we can noop
+			if err == nil &&
+				statCF.ModTime().After(statDB.ModTime()) &&
+				statCF.ModTime().After(statUC.ModTime()) {
+				return plan, nil
 			}
 		}
 	}
 
-	// Read all mappings
-	mappings, err := db.readDB()
-	if err != nil {
-		return err
-	}
-
-	// Assemble config
-	config := Config{Services: make([]Service, 1)}
+	// Assemble render config
+	renderConfig := Config{Services: make([]Service, 1)}
 	service := Service{}
 	service.Type = "web"
 	service.Name = db.Domain
@@ -85,7 +159,7 @@ func (db *DB) pushRender() error {
 	service.BuildCommand = ""
 	service.BuildPath = buildPath
 	service.Routes = make([]Route, len(mappings))
-	config.Services[0] = service
+	renderConfig.Services[0] = service
 
 	// Extract codes and sort (or render.yaml routes are randomly ordered)
 	codes := make([]string, len(mappings))
@@ -100,29 +174,33 @@ func (db *DB) pushRender() error {
 	i = 0
 	for _, code := range codes {
 		service.Routes[i].Type = "redirect"
-		// Handle `indexCode` specially
+		// Handle `indexCode` specially. Private entries still get
+		// redirect routes, since render never lists codes, and Push
+		// refuses to publish a private INDEX at /.
 		if code == indexCode {
 			service.Routes[i].Source = "/"
 		} else {
-			service.Routes[i].Source = "/" + code
+			// Render matches routes against the raw request path, so
+			// non-ascii codes need to be percent-encoded
+			service.Routes[i].Source = codePath(code)
 		}
 		service.Routes[i].Destination = mappings[code]
 		i++
 	}
 
 	// Output
-	data, err := yaml.Marshal(config)
+	data, err := yaml.Marshal(renderConfig)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tmpfile := configfile + ".tmp"
 	err = ioutil.WriteFile(tmpfile, data, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = os.Rename(tmpfile, configfile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Render seems to require our BuildPath to actually exist, so add `buildPath/.gitignore` if missing
@@ -131,10 +209,10 @@ func (db *DB) pushRender() error {
 	if err != nil && os.IsNotExist(err) {
 		err = os.Mkdir(buildDir, 0755)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 	gifile := filepath.Join(buildDir, ".gitignore")
 	gitignore := `*
@@ -144,11 +222,11 @@ func (db *DB) pushRender() error {
 	if err != nil && os.IsNotExist(err) {
 		err = ioutil.WriteFile(gifile, []byte(gitignore), 0644)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return plan, nil
 }
@@ -0,0 +1,109 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for bulk rewriting of mapping urls,
+either via regex replacement or host migration, in a single
+database update.
+*/
+
+package usher
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// RewriteOptions are optional settings for rewrites
+type RewriteOptions struct {
+	DryRun bool // report changes without updating the database
+	Force  bool // skip url validation and normalisation of rewritten urls
+}
+
+// Rewrite records a change to the url of a mapping
+type Rewrite struct {
+	Code   string
+	OldUrl string
+	NewUrl string
+}
+
+// RewriteRegexp replaces matches of from with to (which may include
+// regexp.Expand-style `$1` references) in all mapping urls, returning
+// the changes made, sorted by code
+func (db *DB) RewriteRegexp(from *regexp.Regexp, to string, opts RewriteOptions) ([]Rewrite, error) {
+	return db.rewrite(func(url string) string {
+		return from.ReplaceAllString(url, to)
+	}, opts)
+}
+
+// RewriteHost changes the host of all mapping urls with host oldHost
+// to newHost, returning the changes made, sorted by code. Subdomains
+// of oldHost are not changed.
+func (db *DB) RewriteHost(oldHost, newHost string, opts RewriteOptions) ([]Rewrite, error) {
+	oldHost = normaliseHost(oldHost)
+	if oldHost == "" || newHost == "" {
+		return nil, fmt.Errorf("invalid host rewrite %q => %q", oldHost, newHost)
+	}
+
+	return db.rewrite(func(rawurl string) string {
+		u, err := url.Parse(rawurl)
+		if err != nil || normaliseHost(u.Hostname()) != oldHost {
+			return rawurl
+		}
+		if port := u.Port(); port != "" {
+			u.Host = newHost + ":" + port
+		} else {
+			u.Host = newHost
+		}
+		return u.String()
+	}, opts)
+}
+
+// rewrite is a utility function to apply fn to all mapping urls,
+// checking the new urls against current url policies, and writing
+// all changes in a single update (unless opts.DryRun)
+func (db *DB) rewrite(fn func(url string) string, opts RewriteOptions) ([]Rewrite, error) {
+	mappings, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := db.readUrlPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	var rewrites []Rewrite
+	for code, entry := range mappings {
+		oldUrl := entry.Url
+		newUrl := fn(oldUrl)
+		if newUrl == oldUrl {
+			continue
+		}
+		newUrl, err = policy.apply(newUrl, opts.Force)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite of %q failed: %w", code, err)
+		}
+		if newUrl == oldUrl {
+			continue
+		}
+		rewrites = append(rewrites, Rewrite{Code: code, OldUrl: oldUrl, NewUrl: newUrl})
+	}
+	sort.Slice(rewrites, func(i, j int) bool {
+		return rewrites[i].Code < rewrites[j].Code
+	})
+
+	if opts.DryRun || len(rewrites) == 0 {
+		return rewrites, nil
+	}
+
+	for _, r := range rewrites {
+		mappings[r.Code].Url = r.NewUrl
+	}
+	err = db.writeDB(mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	return rewrites, nil
+}
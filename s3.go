@@ -7,65 +7,1539 @@ This file contains functions for pushing database mappings to Amazon S3.
 package usher
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/s3"
+	yaml "gopkg.in/yaml.v3"
 )
 
-func (db *DB) pushS3Mapping(ctx context.Context, awsS3 *s3.S3, config *ConfigEntry, code, url string) error {
-	_, err := awsS3.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(db.Domain),
-		ContentType: aws.String("text/plain"),
-		Key:         aws.String(code),
-		WebsiteRedirectLocation: aws.String(url),
-	})
+// s3Timeout is the timeout for each S3 request
+const s3Timeout = 10 * time.Second
+
+// s3ManagedKey is the metadata key (`x-amz-meta-usher`) marking redirect
+// objects as managed by usher, and so safe to prune
+const s3ManagedKey = "Usher"
+
+// Metadata keys describing redirect objects. Titles are RFC 2047
+// encoded if not plain ASCII, and created times are RFC 3339.
+// s3SettingsKey is a digest of all the object settings and metadata
+// (except the version), used to detect objects needing an update.
+const (
+	s3VersionKey  = "Usher-Version"
+	s3TitleKey    = "Usher-Title"
+	s3CreatedKey  = "Usher-Created"
+	s3SettingsKey = "Usher-Settings"
+)
+
+// Website documents published alongside redirect objects (if
+// s3_documents is true). They are marked with s3DocumentKey metadata
+// (`x-amz-meta-usher-document`) rather than s3ManagedKey, so they're
+// never treated as codes.
+const (
+	s3IndexDocument  = "index.html"
+	s3ErrorDocument  = "404.html"
+	s3RobotsDocument = "robots.txt"
+	s3DocumentKey    = "Usher-Document"
+)
+
+// s3_index modes, for the index document
+const (
+	s3IndexRedirect  = "redirect"  // redirect to the INDEX url, if any (default)
+	s3IndexDirectory = "directory" // an HTML directory of public links
+	s3IndexNone      = "none"      // no index document
+)
+
+// s3DefaultErrorPage is the default 404.html error document
+const s3DefaultErrorPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Not found</title>
+</head>
+<body>
+<h1>Not found</h1>
+<p>There's no %[1]s link here - please check the url.</p>
+</body>
+</html>
+`
+
+// s3DefaultRobots is the default robots.txt document, which allows
+// all crawling
+const s3DefaultRobots = "User-agent: *\nDisallow:\n"
+
+// s3DefaultPruneLimit is the default maximum number of objects a push
+// will delete without PushOptions.Force
+const s3DefaultPruneLimit = 25
+
+// s3DefaultConcurrency is the default number of concurrent S3 requests
+const s3DefaultConcurrency = 8
+
+// s3DefaultRetries is the default number of times failed S3 requests are
+// retried, with exponential backoff between s3RetryBaseDelay and
+// s3RetryMaxDelay
+const s3DefaultRetries = 5
+const s3RetryBaseDelay = 200 * time.Millisecond
+const s3RetryMaxDelay = 10 * time.Second
+
+// s3Options are the config options for the s3 backend
+type s3Options struct {
+	AWSKey      string `yaml:"aws_key"`        // static credentials (default: SDK credential chain)
+	AWSSecret   string `yaml:"aws_secret"`     // static credentials (default: SDK credential chain)
+	AWSRegion   string `yaml:"aws_region"`     // region (default: from environment or profile)
+	AWSProfile  string `yaml:"aws_profile"`    // shared config/credentials profile
+	RoleArn     string `yaml:"role_arn"`       // role to assume
+	Bucket      string `yaml:"s3_bucket"`      // bucket name (default domain)
+	Endpoint    string `yaml:"s3_endpoint"`    // S3-compatible service url (default AWS)
+	PathStyle   bool   `yaml:"s3_path_style"`  // use path-style bucket addressing
+	CABundle    string `yaml:"s3_ca_bundle"`   // PEM file of CA certificates to trust
+	PruneLimit  *int   `yaml:"prune_limit"`    // max deletions without --force (default 25)
+	Concurrency int    `yaml:"s3_concurrency"` // max concurrent requests (default 8)
+	Retries     *int   `yaml:"s3_retries"`     // max retries per request (default 5)
+
+	// Object settings
+	CacheControl string                `yaml:"s3_cache_control"`  // Cache-Control header
+	ACL          string                `yaml:"s3_acl"`            // canned ACL e.g. public-read
+	StorageClass string                `yaml:"s3_storage_class"`  // e.g. STANDARD, INTELLIGENT_TIERING
+	SSE          string                `yaml:"s3_sse"`            // server-side encryption: AES256 or aws:kms
+	SSEKMSKeyID  string                `yaml:"s3_sse_kms_key_id"` // KMS key for aws:kms encryption
+	Metadata     map[string]string     `yaml:"s3_metadata"`       // extra x-amz-meta-* metadata
+	Overrides    map[string]s3Override `yaml:"s3_overrides"`      // object settings for particular codes
+
+	// Website documents
+	Documents     bool   `yaml:"s3_documents"`      // publish website documents
+	Index         string `yaml:"s3_index"`          // index document: redirect, directory, or none
+	ErrorDocument string `yaml:"s3_error_document"` // HTML file to publish as 404.html (default generated)
+	Robots        string `yaml:"s3_robots"`         // file to publish as robots.txt (default allows all)
+}
+
+// s3Override is the object settings for a particular code (from the
+// s3_overrides option), replacing the corresponding s3_ settings, and
+// adding to (or replacing) s3_metadata
+type s3Override struct {
+	CacheControl string            `yaml:"cache_control"`
+	ACL          string            `yaml:"acl"`
+	StorageClass string            `yaml:"storage_class"`
+	Metadata     map[string]string `yaml:"metadata"`
+}
+
+// s3OverrideAttrs is an alias type for s3Override without the yaml
+// methods, for use by them
+type s3OverrideAttrs s3Override
+
+// UnmarshalYAML unmarshals an s3Override, rejecting unknown settings
+func (o *s3Override) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			switch key := value.Content[i].Value; key {
+			case "cache_control", "acl", "storage_class", "metadata":
+			default:
+				return fmt.Errorf("unknown s3_overrides setting %q", key)
+			}
+		}
+	}
+	return value.Decode((*s3OverrideAttrs)(o))
+}
+
+// s3Object is the redirect state of an existing bucket object
+type s3Object struct {
+	Url      string // website redirect location, if any
+	Managed  bool   // has the usher marker
+	Settings string // settings digest, for managed objects and documents
+	Document bool   // is a website document published by usher
+}
+
+// s3Document is a website document published by usher
+type s3Document struct {
+	Key         string
+	ContentType string
+	Body        []byte
+	Redirect    string // website redirect location, for redirect documents
+}
+
+// s3Backend publishes mappings as S3 website redirect objects, in a
+// bucket named for the domain (or s3_bucket). Any S3-compatible service
+// can be used by setting s3_endpoint (and usually s3_path_style).
+//
+// Objects are described by x-amz-meta-usher-* metadata (the entry title
+// and created time, and the usher version), and object settings like
+// Cache-Control come from the config. Push deletes objects created by
+// usher whose codes have been removed locally (unless
+// PushOptions.NoPrune), but never touches other objects in the bucket.
+//
+// With s3_documents, Push also publishes website documents - an
+// index.html, a 404.html error document and robots.txt - which
+// `usher setup s3` then configures the bucket website to use.
+type s3Backend struct {
+	db      *DB
+	options s3Options
+}
+
+func init() {
+	RegisterBackend("s3", newS3Backend)
+}
+
+// newS3Backend returns a new s3 backend for db using config
+func newS3Backend(db *DB, config *ConfigEntry) (Backend, error) {
+	b := &s3Backend{db: db}
+	err := config.DecodeOptions(&b.options)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			// If the SDK can determine the request or retry delay was canceled
-			// by a context the CanceledErrorCode error code will be returned.
-			return fmt.Errorf("push of %q cancelled due to timeout\n", code)
-		} else {
-			return fmt.Errorf("push of %q failed: %s\n", code, err)
+		return nil, err
+	}
+
+	// Match override codes as database codes, which are NFC
+	if b.options.Overrides != nil {
+		overrides := make(map[string]s3Override, len(b.options.Overrides))
+		for code, override := range b.options.Overrides {
+			overrides[NormaliseCode(code)] = override
 		}
+		b.options.Overrides = overrides
 	}
+	return b, nil
+}
 
+// Validate checks the s3 backend options
+func (b *s3Backend) Validate() error {
+	if (b.options.AWSKey == "") != (b.options.AWSSecret == "") {
+		return errors.New("s3 backend requires both aws_key and aws_secret options, or neither")
+	}
+	if b.options.AWSKey != "" && b.options.AWSProfile != "" {
+		return errors.New("s3 backend aws_profile cannot be used with aws_key and aws_secret")
+	}
+	if b.options.Endpoint != "" {
+		u, err := url.Parse(b.options.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("s3 backend s3_endpoint %q is not a valid http(s) url", b.options.Endpoint)
+		}
+	}
+	if b.options.CABundle != "" {
+		_, err := os.Stat(b.options.CABundle)
+		if err != nil {
+			return fmt.Errorf("s3 backend s3_ca_bundle: %s", err)
+		}
+	}
+	if b.options.PruneLimit != nil && *b.options.PruneLimit < 0 {
+		return errors.New("s3 backend prune_limit must not be negative")
+	}
+	if b.options.Concurrency < 0 {
+		return errors.New("s3 backend s3_concurrency must not be negative")
+	}
+	if b.options.Retries != nil && *b.options.Retries < 0 {
+		return errors.New("s3 backend s3_retries must not be negative")
+	}
+	for option, value := range map[string]struct {
+		value  string
+		values []string
+	}{
+		"s3_acl":           {b.options.ACL, s3.ObjectCannedACL_Values()},
+		"s3_storage_class": {b.options.StorageClass, s3.StorageClass_Values()},
+		"s3_sse":           {b.options.SSE, s3.ServerSideEncryption_Values()},
+	} {
+		err := checkS3Value(option, value.value, value.values)
+		if err != nil {
+			return err
+		}
+	}
+	if b.options.SSEKMSKeyID != "" && b.options.SSE != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("s3 backend s3_sse_kms_key_id requires s3_sse: %s", s3.ServerSideEncryptionAwsKms)
+	}
+	switch b.options.Index {
+	case "", s3IndexRedirect, s3IndexDirectory, s3IndexNone:
+	default:
+		return fmt.Errorf("s3 backend s3_index %q is invalid (must be one of: %s, %s, %s)",
+			b.options.Index, s3IndexRedirect, s3IndexDirectory, s3IndexNone)
+	}
+	for option, path := range map[string]string{
+		"s3_error_document": b.options.ErrorDocument,
+		"s3_robots":         b.options.Robots,
+	} {
+		if path != "" {
+			_, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("s3 backend %s: %s", option, err)
+			}
+		}
+	}
+	err := checkS3Metadata("s3_metadata", b.options.Metadata)
+	if err != nil {
+		return err
+	}
+	for code, override := range b.options.Overrides {
+		option := fmt.Sprintf("s3_overrides %q", code)
+		err = checkS3Value(option+" acl", override.ACL, s3.ObjectCannedACL_Values())
+		if err != nil {
+			return err
+		}
+		err = checkS3Value(option+" storage_class", override.StorageClass, s3.StorageClass_Values())
+		if err != nil {
+			return err
+		}
+		err = checkS3Metadata(option+" metadata", override.Metadata)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (db *DB) pushS3(config *ConfigEntry) error {
-	// Setup background context with a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// s3PublicACLs are the canned ACLs that grant public access, which are
+// blocked by default on new AWS buckets
+var s3PublicACLs = map[string]bool{
+	s3.ObjectCannedACLPublicRead:        true,
+	s3.ObjectCannedACLPublicReadWrite:   true,
+	s3.ObjectCannedACLAuthenticatedRead: true,
+}
+
+// publicACLs returns true if s3_acl or any s3_overrides acl is public
+func (b *s3Backend) publicACLs() bool {
+	if s3PublicACLs[b.options.ACL] {
+		return true
+	}
+	for _, override := range b.options.Overrides {
+		if s3PublicACLs[override.ACL] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkS3Value checks that value, if set, is one of values
+func checkS3Value(option, value string, values []string) error {
+	if value != "" && !stringIn(value, values) {
+		return fmt.Errorf("s3 backend %s %q is invalid (must be one of: %s)",
+			option, value, strings.Join(values, ", "))
+	}
+	return nil
+}
+
+// checkS3Metadata checks that metadata keys and values are valid
+func checkS3Metadata(option string, metadata map[string]string) error {
+	for key, value := range metadata {
+		if !s3MetadataKeyRE.MatchString(key) || strings.HasPrefix(strings.ToLower(key), "usher") {
+			return fmt.Errorf("s3 backend %s key %q is invalid (keys must be letters, digits, and dashes, and not start with 'usher')", option, key)
+		}
+		if mime.QEncoding.Encode("utf-8", value) != value {
+			return fmt.Errorf("s3 backend %s value for %q must be printable ASCII", option, key)
+		}
+	}
+	return nil
+}
+
+// s3MetadataKeyRE matches valid s3_metadata keys
+var s3MetadataKeyRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// stringIn returns true if s is in values
+func stringIn(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// retries returns the number of times to retry failed requests
+func (b *s3Backend) retries() int {
+	if b.options.Retries != nil {
+		return *b.options.Retries
+	}
+	return s3DefaultRetries
+}
+
+// bucket returns the name of the bucket to publish to
+func (b *s3Backend) bucket() string {
+	if b.options.Bucket != "" {
+		return b.options.Bucket
+	}
+	return b.db.Domain
+}
+
+// concurrency returns the number of concurrent requests to make
+func (b *s3Backend) concurrency() int {
+	if b.options.Concurrency > 0 {
+		return b.options.Concurrency
+	}
+	return s3DefaultConcurrency
+}
+
+// pruneLimit returns the maximum number of deletions allowed without
+// PushOptions.Force
+func (b *s3Backend) pruneLimit() int {
+	if b.options.PruneLimit != nil {
+		return *b.options.PruneLimit
+	}
+	return s3DefaultPruneLimit
+}
+
+// session returns a new AWS session for the configured options, using
+// credentials from baseSession to assume role_arn, if set
+func (b *s3Backend) session() (*session.Session, error) {
+	awsSession, err := b.baseSession()
+	if err != nil {
+		return nil, err
+	}
+	if b.options.RoleArn != "" {
+		awsSession = awsSession.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(awsSession, b.options.RoleArn),
+		})
+	}
+	return awsSession, nil
+}
+
+// baseSession returns a new AWS session for the configured options,
+// ignoring role_arn. Credentials are the static aws_key and aws_secret
+// if configured, or else found by the SDK credential chain (environment
+// variables, the aws_profile or default profile in the shared config and
+// credentials files, web identity tokens, and EC2/ECS roles).
+func (b *s3Backend) baseSession() (*session.Session, error) {
+	awsConfig := aws.Config{
+		MaxRetries:                    aws.Int(0), // we do our own retries, see withRetry
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	}
+	if b.options.AWSKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(b.options.AWSKey, b.options.AWSSecret, "")
+	}
+	if b.options.AWSRegion != "" {
+		awsConfig.Region = aws.String(b.options.AWSRegion)
+	}
+	if b.options.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(b.options.Endpoint)
+	}
+	if b.options.PathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sessionOptions := session.Options{
+		Config:            awsConfig,
+		Profile:           b.options.AWSProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if b.options.CABundle != "" {
+		bundle, err := os.Open(b.options.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		defer bundle.Close()
+		sessionOptions.CustomCABundle = bundle
+	}
+	awsSession, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, fmt.Errorf("s3 session setup failed: %s", err)
+	}
+	if aws.StringValue(awsSession.Config.Region) == "" {
+		return nil, errors.New("s3 backend has no aws_region configured, and none found in the environment or AWS profile")
+	}
+	return awsSession, nil
+}
+
+// client returns a new S3 client for the configured options
+func (b *s3Backend) client() (*s3.S3, error) {
+	awsSession, err := b.session()
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(awsSession), nil
+}
+
+// Doctor checks the bucket settings, credentials, and bucket access
+func (b *s3Backend) Doctor() []Check {
+	endpoint := b.options.Endpoint
+	if endpoint == "" {
+		endpoint = "AWS"
+	}
+	checks := []Check{{Name: "s3 bucket", Result: fmt.Sprintf("%s (at %s)", b.bucket(), endpoint)}}
+
+	baseSession, err := b.baseSession()
+	if err != nil {
+		return append(checks, Check{Name: "s3 session", Err: err})
+	}
+	checks = append(checks, Check{Name: "s3 region", Result: aws.StringValue(baseSession.Config.Region)})
+
+	// Report which source the credentials were found in
+	creds, err := baseSession.Config.Credentials.Get()
+	if err != nil {
+		return append(checks, Check{Name: "s3 credentials", Err: err})
+	}
+	source := creds.ProviderName
+	if b.options.AWSKey != "" {
+		source += " (aws_key)"
+	} else if b.options.AWSProfile != "" {
+		source += fmt.Sprintf(" (profile %q)", b.options.AWSProfile)
+	}
+	checks = append(checks, Check{Name: "s3 credentials", Result: source})
 
-	// Create AWS session and S3 objects
-	awsSession := session.Must(session.NewSession())
-	awsCredentials := credentials.NewStaticCredentials(config.AWSKey, config.AWSSecret, "")
-	awsS3 := s3.New(awsSession, &aws.Config{
-		Credentials: awsCredentials,
-		Region:      aws.String(config.AWSRegion),
+	awsSession, err := b.session()
+	if err != nil {
+		return append(checks, Check{Name: "s3 session", Err: err})
+	}
+	if b.options.RoleArn != "" {
+		_, err = awsSession.Config.Credentials.Get()
+		if err != nil {
+			return append(checks, Check{Name: "s3 role", Err: err})
+		}
+		checks = append(checks, Check{Name: "s3 role", Result: b.options.RoleArn})
+	}
+
+	// Check we can access the bucket
+	awsS3 := s3.New(awsSession)
+	err = b.withRetry(context.Background(), func(ctx context.Context) error {
+		_, err := awsS3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(b.bucket()),
+		})
+		return err
 	})
+	if err != nil {
+		return append(checks, Check{Name: "s3 access", Err: s3Error("bucket access", err)})
+	}
+	return append(checks, Check{Name: "s3 access", Result: "ok"})
+}
 
-	// Read all mappings
-	mappings, err := db.readDB()
+// Plan returns the changes a Push of mappings would make
+func (b *s3Backend) Plan(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	err := b.checkCodes(mappings)
+	if err != nil {
+		return nil, err
+	}
+	awsS3, err := b.client()
 	if err != nil {
+		return nil, err
+	}
+	entries, err := b.db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := b.list(opts.ctx(), awsS3)
+	if err != nil {
+		return nil, err
+	}
+	return b.plan(objects, mappings, entries, opts), nil
+}
+
+// checkCodes returns an error if any codes in mappings clash with the
+// website documents usher publishes
+func (b *s3Backend) checkCodes(mappings map[string]string) error {
+	if !b.options.Documents {
+		return nil
+	}
+	for _, key := range []string{s3IndexDocument, s3ErrorDocument, s3RobotsDocument} {
+		if _, exists := mappings[key]; exists {
+			return fmt.Errorf("code %q clashes with the s3 website document of the same name (rename the code, or disable s3_documents)", key)
+		}
+	}
+	return nil
+}
+
+// plan is a utility function to return the changes needed to sync
+// objects with mappings. Objects whose urls are unchanged but whose
+// settings or metadata differ are updated. Only managed objects are
+// deleted.
+func (b *s3Backend) plan(objects map[string]s3Object, mappings map[string]string, entries map[string]*Entry, opts PushOptions) *Plan {
+	current := make(map[string]string)
+	for key, obj := range objects {
+		if obj.Url != "" && (obj.Managed || mappings[key] != "") {
+			current[key] = obj.Url
+		}
+	}
+	plan := diffMappings(current, mappings, !opts.NoPrune)
+	for i, change := range plan.Changes {
+		if change.Action != ActionUnchanged {
+			continue
+		}
+		input := b.putInput(change.Code, change.Url, entries[change.Code])
+		if objects[change.Code].Settings != aws.StringValue(input.Metadata[s3SettingsKey]) {
+			plan.Changes[i].Action = ActionUpdate
+			plan.Changes[i].OldUrl = change.Url
+		}
+	}
+	return plan
+}
+
+// Push syncs the bucket with mappings, uploading redirect objects only
+// for new and changed codes, and deleting managed objects for codes no
+// longer in mappings. It returns the changes made. Uploads are made
+// concurrently, and failures for individual codes are returned together
+// as PushErrors.
+//
+// Website documents are uploaded after the codes, if changed, but
+// existing objects not published by usher are never overwritten.
+//
+// Progress is recorded in a state file while the push runs, so that if
+// it's interrupted or some codes fail, a push with PushOptions.Resume
+// applies just the outstanding changes, without re-reading the bucket.
+func (b *s3Backend) Push(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	ctx := opts.ctx()
+	err := b.checkCodes(mappings)
+	if err != nil {
+		return nil, err
+	}
+	awsS3, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := b.db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	var docs []s3Document
+	if b.options.Documents {
+		docs, err = b.websiteDocuments(mappings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var plan *Plan
+	var objects map[string]s3Object
+	if opts.Resume {
+		state, err := b.readState()
+		if err != nil {
+			return nil, err
+		}
+		err = state.check(mappings)
+		if err != nil {
+			return nil, err
+		}
+		plan = &Plan{Changes: state.Changes}
+	} else {
+		objects, err = b.list(ctx, awsS3)
+		if err != nil {
+			return nil, err
+		}
+		plan = b.plan(objects, mappings, entries, opts)
+
+		deletes := plan.Count(ActionDelete)
+		if deletes > b.pruneLimit() && !opts.Force {
+			return nil, fmt.Errorf("push would delete %d objects from bucket %q, more than the limit of %d (use --force to override, or --no-prune to skip deletions)",
+				deletes, b.bucket(), b.pruneLimit())
+		}
+	}
+
+	// Record the outstanding changes before making any
+	state := &s3PushState{Started: time.Now().UTC()}
+	for _, change := range plan.Changes {
+		if change.Action != ActionUnchanged {
+			state.Changes = append(state.Changes, change)
+		}
+	}
+	err = b.writeState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	// Push new and changed code-url pairs to s3, and collect removed codes
+	done := make(map[string]bool)
+	var mu sync.Mutex
+	var codes, keys []string
+	for _, change := range state.Changes {
+		switch change.Action {
+		case ActionCreate, ActionUpdate:
+			codes = append(codes, change.Code)
+		case ActionDelete:
+			keys = append(keys, change.Code)
+		}
+	}
+	errs := b.forEach(ctx, codes, func(ctx context.Context, code string) error {
+		err := b.pushMapping(ctx, awsS3, b.putInput(code, mappings[code], entries[code]))
+		if err == nil {
+			mu.Lock()
+			done[code] = true
+			mu.Unlock()
+		}
 		return err
+	})
+
+	// Delete removed codes
+	if ctx.Err() == nil {
+		delErrs := b.deleteKeys(ctx, awsS3, keys)
+		failed := make(map[string]bool)
+		for _, e := range delErrs {
+			failed[e.Code] = true
+		}
+		for _, key := range keys {
+			if !failed[key] {
+				done[key] = true
+			}
+		}
+		errs = append(errs, delErrs...)
+	}
+
+	// Publish changed website documents. These aren't recorded in the
+	// state file, so resumed pushes leave them to the next full push.
+	if b.options.Documents && !opts.Resume && ctx.Err() == nil {
+		errs = append(errs, b.pushDocuments(ctx, awsS3, docs, objects)...)
 	}
 
-	// Push each code-url pair to s3
-	for code, url := range mappings {
-		//fmt.Printf("+ pushing %s => %s\n", code, url)
-		err = db.pushS3Mapping(ctx, awsS3, config, code, url)
+	// Record the changes still outstanding, if any
+	state.Changes = state.pending(done)
+	if len(state.Changes) == 0 {
+		err = b.removeState()
+	} else {
+		err = b.writeState(state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil && len(state.Changes) > 0 {
+		return nil, fmt.Errorf("push to bucket %q cancelled, with %d change(s) outstanding (use --resume to continue): %w",
+			b.bucket(), len(state.Changes), ctx.Err())
+	}
+	if len(errs) > 0 {
+		return plan, errs
+	}
+	return plan, nil
+}
+
+// forEach calls fn for each code, using a pool of concurrent workers,
+// and returns any errors. No more calls are made once ctx is done.
+func (b *s3Backend) forEach(ctx context.Context, codes []string, fn func(ctx context.Context, code string) error) PushErrors {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs PushErrors
+	)
+	jobs := make(chan string)
+	for i := 0; i < b.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for code := range jobs {
+				err := fn(ctx, code)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, CodeError{Code: code, Err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+Feed:
+	for _, code := range codes {
+		select {
+		case jobs <- code:
+		case <-ctx.Done():
+			break Feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Code < errs[j].Code
+	})
+	return errs
+}
+
+// s3Retryable returns true if err is a transient S3 error, worth retrying
+func s3Retryable(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	return false
+}
+
+// withRetry calls fn, with a timeout for each attempt, and retries
+// transient errors and timeouts using exponential backoff with jitter.
+// It returns the error from the last attempt.
+func (b *s3Backend) withRetry(ctx context.Context, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, s3Timeout)
+		err := fn(reqCtx)
+		timedOut := reqCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= b.retries() {
+			return err
+		}
+		if !timedOut && !s3Retryable(err) {
+			return err
+		}
+
+		// Wait between half and all of the backoff delay
+		delay := s3RetryMaxDelay
+		if attempt < 16 && s3RetryBaseDelay<<uint(attempt) < s3RetryMaxDelay {
+			delay = s3RetryBaseDelay << uint(attempt)
+		}
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// s3Error returns a readable error for a failed S3 operation
+func s3Error(op string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		// If the SDK can determine the request or retry delay was canceled
+		// by a context the CanceledErrorCode error code will be returned.
+		return fmt.Errorf("%s cancelled or timed out", op)
+	}
+	return fmt.Errorf("%s failed: %s", op, err)
+}
+
+// putInput returns the upload request for a redirect object for code
+// to url, described by entry (if not nil)
+func (b *s3Backend) putInput(code, url string, entry *Entry) *s3.PutObjectInput {
+	// S3 website endpoints decode request paths before key lookup, so
+	// keys are stored as raw (NFC) codes - the SDK does any encoding
+	// required on the wire
+	input := &s3.PutObjectInput{
+		Bucket:                  aws.String(b.bucket()),
+		ContentType:             aws.String("text/plain"),
+		Key:                     aws.String(code),
+		Metadata:                map[string]*string{s3ManagedKey: aws.String("1")},
+		WebsiteRedirectLocation: aws.String(url),
+	}
+	if entry != nil && entry.Title != "" {
+		input.Metadata[s3TitleKey] = aws.String(mime.QEncoding.Encode("utf-8", entry.Title))
+	}
+	if entry != nil && !entry.Created.IsZero() {
+		input.Metadata[s3CreatedKey] = aws.String(entry.Created.UTC().Format(time.RFC3339))
+	}
+	b.applySettings(input, b.options.Overrides[code])
+	return input
+}
+
+// applySettings applies the configured object settings and metadata to
+// input, with override applied over them, and records a digest of them
+// (and of extra, if given) in the s3SettingsKey metadata
+func (b *s3Backend) applySettings(input *s3.PutObjectInput, override s3Override, extra ...string) {
+	if b.options.CacheControl != "" {
+		input.CacheControl = aws.String(b.options.CacheControl)
+	}
+	if b.options.ACL != "" {
+		input.ACL = aws.String(b.options.ACL)
+	}
+	if b.options.StorageClass != "" {
+		input.StorageClass = aws.String(b.options.StorageClass)
+	}
+	if b.options.SSE != "" {
+		input.ServerSideEncryption = aws.String(b.options.SSE)
+	}
+	if b.options.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(b.options.SSEKMSKeyID)
+	}
+	for key, value := range b.options.Metadata {
+		input.Metadata[key] = aws.String(value)
+	}
+	if override.CacheControl != "" {
+		input.CacheControl = aws.String(override.CacheControl)
+	}
+	if override.ACL != "" {
+		input.ACL = aws.String(override.ACL)
+	}
+	if override.StorageClass != "" {
+		input.StorageClass = aws.String(override.StorageClass)
+	}
+	for key, value := range override.Metadata {
+		// Metadata keys are case-insensitive, so replace any existing key
+		for k := range input.Metadata {
+			if strings.EqualFold(k, key) {
+				delete(input.Metadata, k)
+			}
+		}
+		input.Metadata[key] = aws.String(value)
+	}
+
+	// Digest the settings before adding the version, so upgrading usher
+	// doesn't force every object to be re-uploaded
+	var settings []string
+	for key, value := range input.Metadata {
+		settings = append(settings, "x-amz-meta-"+strings.ToLower(key)+": "+aws.StringValue(value))
+	}
+	sort.Strings(settings)
+	settings = append(settings,
+		"cache-control: "+aws.StringValue(input.CacheControl),
+		"acl: "+aws.StringValue(input.ACL),
+		"storage-class: "+aws.StringValue(input.StorageClass),
+		"sse: "+aws.StringValue(input.ServerSideEncryption),
+		"sse-kms-key-id: "+aws.StringValue(input.SSEKMSKeyId),
+	)
+	settings = append(settings, extra...)
+	digest := sha256.Sum256([]byte(strings.Join(settings, "\n")))
+	input.Metadata[s3SettingsKey] = aws.String(hex.EncodeToString(digest[:8]))
+	input.Metadata[s3VersionKey] = aws.String(Version)
+}
+
+// pushMapping uploads a redirect object using input
+func (b *s3Backend) pushMapping(ctx context.Context, awsS3 *s3.S3, input *s3.PutObjectInput) error {
+	err := b.withRetry(ctx, func(ctx context.Context) error {
+		_, err := awsS3.PutObjectWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return s3Error("upload", err)
+	}
+
+	return nil
+}
+
+// websiteDocuments returns the website documents to publish for
+// mappings. There's no index document for s3_index none, or for
+// s3_index redirect (the default) if there's no INDEX mapping.
+func (b *s3Backend) websiteDocuments(mappings map[string]string) ([]s3Document, error) {
+	var docs []s3Document
+	switch b.options.Index {
+	case "", s3IndexRedirect:
+		if url, exists := mappings[indexCode]; exists {
+			docs = append(docs, s3Document{Key: s3IndexDocument, ContentType: "text/html; charset=utf-8", Redirect: url})
+		}
+	case s3IndexDirectory:
+		var buf bytes.Buffer
+		err := b.db.Export(&buf, ExportOptions{Format: FormatHTML})
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, s3Document{Key: s3IndexDocument, ContentType: "text/html; charset=utf-8", Body: buf.Bytes()})
+	}
+
+	errorPage := []byte(fmt.Sprintf(s3DefaultErrorPage, html.EscapeString(b.db.Domain)))
+	if b.options.ErrorDocument != "" {
+		var err error
+		errorPage, err = ioutil.ReadFile(b.options.ErrorDocument)
+		if err != nil {
+			return nil, err
+		}
+	}
+	docs = append(docs, s3Document{Key: s3ErrorDocument, ContentType: "text/html; charset=utf-8", Body: errorPage})
+
+	robots := []byte(s3DefaultRobots)
+	if b.options.Robots != "" {
+		var err error
+		robots, err = ioutil.ReadFile(b.options.Robots)
 		if err != nil {
+			return nil, err
+		}
+	}
+	docs = append(docs, s3Document{Key: s3RobotsDocument, ContentType: "text/plain; charset=utf-8", Body: robots})
+
+	return docs, nil
+}
+
+// documentInput returns the upload request for doc, without a body
+func (b *s3Backend) documentInput(doc s3Document) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket()),
+		ContentType: aws.String(doc.ContentType),
+		Key:         aws.String(doc.Key),
+		Metadata:    map[string]*string{s3DocumentKey: aws.String("1")},
+	}
+	if doc.Redirect != "" {
+		input.WebsiteRedirectLocation = aws.String(doc.Redirect)
+	}
+	content := sha256.Sum256(doc.Body)
+	b.applySettings(input, s3Override{},
+		"content-type: "+doc.ContentType,
+		"content: "+hex.EncodeToString(content[:]),
+		"redirect: "+doc.Redirect,
+	)
+	return input
+}
+
+// pushDocuments uploads the docs that are missing or changed in
+// objects, and deletes website documents usher published previously
+// that are no longer wanted. Objects not published by usher are left
+// alone, and reported as errors.
+func (b *s3Backend) pushDocuments(ctx context.Context, awsS3 *s3.S3, docs []s3Document, objects map[string]s3Object) PushErrors {
+	var errs PushErrors
+	wanted := make(map[string]bool)
+	for _, doc := range docs {
+		wanted[doc.Key] = true
+		input := b.documentInput(doc)
+		obj, exists := objects[doc.Key]
+		if exists && !obj.Document {
+			errs = append(errs, CodeError{Code: doc.Key,
+				Err: errors.New("existing object not published by usher (delete it, or disable s3_documents)")})
+			continue
+		}
+		if exists && obj.Settings == aws.StringValue(input.Metadata[s3SettingsKey]) {
+			continue
+		}
+		body := doc.Body
+		err := b.withRetry(ctx, func(ctx context.Context) error {
+			// Each attempt consumes the body, so give it a fresh reader
+			input.Body = bytes.NewReader(body)
+			_, err := awsS3.PutObjectWithContext(ctx, input)
 			return err
+		})
+		if err != nil {
+			errs = append(errs, CodeError{Code: doc.Key, Err: s3Error("upload", err)})
 		}
 	}
 
+	var stale []string
+	for _, key := range []string{s3IndexDocument, s3ErrorDocument, s3RobotsDocument} {
+		if !wanted[key] && objects[key].Document {
+			stale = append(stale, key)
+		}
+	}
+	return append(errs, b.deleteKeys(ctx, awsS3, stale)...)
+}
+
+// deleteKeys deletes the objects with keys from the bucket, in batches
+// of up to 1000 (the DeleteObjects limit), and returns errors for any
+// keys not deleted
+func (b *s3Backend) deleteKeys(ctx context.Context, awsS3 *s3.S3, keys []string) PushErrors {
+	var errs PushErrors
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		objects := make([]*s3.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+		}
+		var out *s3.DeleteObjectsOutput
+		err := b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			out, err = awsS3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(b.bucket()),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			return err
+		})
+		if err != nil {
+			for _, key := range batch {
+				errs = append(errs, CodeError{Code: key, Err: s3Error("delete", err)})
+			}
+			continue
+		}
+		for _, e := range out.Errors {
+			errs = append(errs, CodeError{
+				Code: aws.StringValue(e.Key),
+				Err:  fmt.Errorf("delete failed: %s", aws.StringValue(e.Message)),
+			})
+		}
+	}
+	return errs
+}
+
+// list returns the redirect state of all objects in the bucket. Listings
+// don't include redirect locations, so each object is also read with a
+// HEAD request.
+func (b *s3Backend) list(ctx context.Context, awsS3 *s3.S3) (map[string]s3Object, error) {
+	var keys []string
+	err := b.withRetry(ctx, func(ctx context.Context) error {
+		keys = nil
+		return awsS3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(b.bucket()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+	})
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("listing bucket %q cancelled: %w", b.bucket(), ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing bucket %q failed: %s", b.bucket(), err)
+	}
+
+	var mu sync.Mutex
+	objects := make(map[string]s3Object, len(keys))
+	errs := b.forEach(ctx, keys, func(ctx context.Context, key string) error {
+		var head *s3.HeadObjectOutput
+		err := b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			head, err = awsS3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(b.bucket()),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+		if err != nil {
+			return s3Error("read", err)
+		}
+		_, managed := head.Metadata[s3ManagedKey]
+		_, document := head.Metadata[s3DocumentKey]
+		mu.Lock()
+		objects[key] = s3Object{
+			Url:      aws.StringValue(head.WebsiteRedirectLocation),
+			Managed:  managed,
+			Settings: aws.StringValue(head.Metadata[s3SettingsKey]),
+			Document: document,
+		}
+		mu.Unlock()
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("listing bucket %q cancelled: %w", b.bucket(), ctx.Err())
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return objects, nil
+}
+
+// s3PushState records the changes outstanding for an S3 push, so an
+// interrupted or partly failed push can be resumed
+type s3PushState struct {
+	Started time.Time `json:"started"`
+	Changes []Change  `json:"changes"`
+}
+
+// statePath returns the path of the push state file for the bucket
+func (b *s3Backend) statePath() string {
+	return filepath.Join(b.db.Root, "."+b.db.Domain+".push.json")
+}
+
+// readState returns the push state for an interrupted push
+func (b *s3Backend) readState() (*s3PushState, error) {
+	data, err := ioutil.ReadFile(b.statePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no interrupted push to bucket %q found to resume", b.bucket())
+		}
+		return nil, err
+	}
+	var state s3PushState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid push state file %q: %s", b.statePath(), err)
+	}
+	return &state, nil
+}
+
+// writeState atomically writes state to the push state file
+func (b *s3Backend) writeState(state *s3PushState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpfile := b.statePath() + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, b.statePath())
+}
+
+// removeState removes the push state file, if it exists
+func (b *s3Backend) removeState() error {
+	err := os.Remove(b.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// check returns an error if mappings have changed since the push
+// recorded in state started, since resuming it would be inconsistent
+func (state *s3PushState) check(mappings map[string]string) error {
+	for _, change := range state.Changes {
+		url, exists := mappings[change.Code]
+		switch {
+		case change.Action == ActionDelete && exists,
+			change.Action != ActionDelete && url != change.Url:
+			return fmt.Errorf("mapping for %q has changed since the interrupted push - run a full push instead of resuming", change.Code)
+		}
+	}
+	return nil
+}
+
+// pending returns the changes in state whose codes are not done
+func (state *s3PushState) pending(done map[string]bool) []Change {
+	var changes []Change
+	for _, change := range state.Changes {
+		if !done[change.Code] {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// Pull returns the redirect mappings currently in the bucket. Objects
+// without a redirect location, and website documents, are ignored.
+func (b *s3Backend) Pull() (map[string]string, error) {
+	awsS3, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := b.list(context.Background(), awsS3)
+	if err != nil {
+		return nil, err
+	}
+	mappings := make(map[string]string, len(objects))
+	for key, obj := range objects {
+		if obj.Url != "" && !obj.Document {
+			mappings[key] = obj.Url
+		}
+	}
+	return mappings, nil
+}
+
+// s3PublicReadPolicy is the bucket policy making objects in a bucket
+// publicly readable, so redirects work
+const s3PublicReadPolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Sid": "PublicRead",
+      "Effect": "Allow",
+      "Principal": "*",
+      "Action": "s3:GetObject",
+      "Resource": "arn:aws:s3:::%[1]s/*"
+    }
+  ]
+}`
+
+// s3WritePolicy is the IAM policy granting the access usher needs to
+// push to a bucket (including setting canned ACLs, for s3_acl)
+const s3WritePolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": ["s3:GetObject", "s3:PutObject", "s3:PutObjectAcl", "s3:DeleteObject"],
+      "Resource": "arn:aws:s3:::%[1]s/*"
+    },
+    {
+      "Effect": "Allow",
+      "Action": ["s3:ListBucket"],
+      "Resource": "arn:aws:s3:::%[1]s"
+    }
+  ]
+}`
+
+// awsErrorCode returns the AWS error code for err, if any
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// samePolicy returns true if JSON policy documents a and b are equivalent
+func samePolicy(a, b string) bool {
+	var av, bv interface{}
+	if json.Unmarshal([]byte(a), &av) != nil || json.Unmarshal([]byte(b), &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// Setup returns the changes needed to create and configure the bucket
+// for website hosting with public-read redirects (allowing public ACLs,
+// if s3_acl or s3_overrides use them), and optionally to grant
+// opts.IAMUser write access to it
+func (b *s3Backend) Setup(opts SetupOptions) (*Setup, error) {
+	if opts.IAMUser != "" && b.options.Endpoint != "" {
+		return nil, errors.New("IAM user setup is only supported for AWS, not custom s3_endpoint services")
+	}
+	awsSession, err := b.session()
+	if err != nil {
+		return nil, err
+	}
+	awsS3 := s3.New(awsSession)
+	ctx := context.Background()
+	bucket := b.bucket()
+	region := aws.StringValue(awsSession.Config.Region)
+	setup := &Setup{}
+
+	// Bucket
+	exists := true
+	err = b.withRetry(ctx, func(ctx context.Context) error {
+		_, err := awsS3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+		return err
+	})
+	if err != nil {
+		if awsErrorCode(err) != "NotFound" {
+			return nil, s3Error(fmt.Sprintf("checking bucket %q", bucket), err)
+		}
+		exists = false
+		setup.add(fmt.Sprintf("create bucket %q in %s", bucket, region), func() error {
+			input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+			if region != "us-east-1" {
+				input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+					LocationConstraint: aws.String(region),
+				}
+			}
+			return b.withRetry(ctx, func(ctx context.Context) error {
+				_, err := awsS3.CreateBucketWithContext(ctx, input)
+				return err
+			})
+		})
+	}
+
+	// Website hosting, using our website documents if published, or
+	// else the INDEX code as the index document
+	index, errorDocument := indexCode, ""
+	if b.options.Documents {
+		index, errorDocument = s3IndexDocument, s3ErrorDocument
+	}
+	needWebsite := !exists
+	if exists {
+		var website *s3.GetBucketWebsiteOutput
+		err = b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			website, err = awsS3.GetBucketWebsiteWithContext(ctx, &s3.GetBucketWebsiteInput{Bucket: aws.String(bucket)})
+			return err
+		})
+		switch {
+		case awsErrorCode(err) == "NoSuchWebsiteConfiguration":
+			needWebsite = true
+		case err != nil:
+			return nil, s3Error("reading website configuration", err)
+		default:
+			needWebsite = website.IndexDocument == nil ||
+				aws.StringValue(website.IndexDocument.Suffix) != index
+			if errorDocument != "" {
+				needWebsite = needWebsite || website.ErrorDocument == nil ||
+					aws.StringValue(website.ErrorDocument.Key) != errorDocument
+			}
+		}
+	}
+	if needWebsite {
+		description := fmt.Sprintf("enable website hosting for bucket %q, with index document %s", bucket, index)
+		config := &s3.WebsiteConfiguration{IndexDocument: &s3.IndexDocument{Suffix: aws.String(index)}}
+		if errorDocument != "" {
+			description += " and error document " + errorDocument
+			config.ErrorDocument = &s3.ErrorDocument{Key: aws.String(errorDocument)}
+		}
+		setup.add(description, func() error {
+			return b.withRetry(ctx, func(ctx context.Context) error {
+				_, err := awsS3.PutBucketWebsiteWithContext(ctx, &s3.PutBucketWebsiteInput{
+					Bucket:               aws.String(bucket),
+					WebsiteConfiguration: config,
+				})
+				return err
+			})
+		})
+	}
+
+	// Public access block settings, which must allow public bucket
+	// policies (new AWS buckets block them by default), and public ACLs
+	// if we use them
+	publicACLs := b.publicACLs()
+	blockACLs, ignoreACLs, needAccess := !publicACLs, !publicACLs, !exists
+	if exists {
+		var access *s3.GetPublicAccessBlockOutput
+		err = b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			access, err = awsS3.GetPublicAccessBlockWithContext(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(bucket)})
+			return err
+		})
+		switch {
+		case awsErrorCode(err) == "NoSuchPublicAccessBlockConfiguration", awsErrorCode(err) == "NotImplemented":
+		case err != nil:
+			return nil, s3Error("reading public access block settings", err)
+		default:
+			c := access.PublicAccessBlockConfiguration
+			needAccess = aws.BoolValue(c.BlockPublicPolicy) || aws.BoolValue(c.RestrictPublicBuckets)
+			if publicACLs {
+				needAccess = needAccess || aws.BoolValue(c.BlockPublicAcls) || aws.BoolValue(c.IgnorePublicAcls)
+			} else {
+				blockACLs, ignoreACLs = aws.BoolValue(c.BlockPublicAcls), aws.BoolValue(c.IgnorePublicAcls)
+			}
+		}
+	}
+	if needAccess {
+		allow := "public bucket policies"
+		if publicACLs {
+			allow = "public bucket policies and ACLs"
+		}
+		setup.add(fmt.Sprintf("allow %s for bucket %q (public access block settings)", allow, bucket), func() error {
+			err := b.withRetry(ctx, func(ctx context.Context) error {
+				_, err := awsS3.PutPublicAccessBlockWithContext(ctx, &s3.PutPublicAccessBlockInput{
+					Bucket: aws.String(bucket),
+					PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+						BlockPublicAcls:       aws.Bool(blockACLs),
+						IgnorePublicAcls:      aws.Bool(ignoreACLs),
+						BlockPublicPolicy:     aws.Bool(false),
+						RestrictPublicBuckets: aws.Bool(false),
+					},
+				})
+				return err
+			})
+			// Some S3-compatible services don't have public access blocks
+			if awsErrorCode(err) == "NotImplemented" {
+				return nil
+			}
+			return err
+		})
+	}
+
+	// Object ownership controls, which must enable ACLs if we use public
+	// ones (new AWS buckets disable ACLs by default)
+	if publicACLs {
+		needOwnership := !exists
+		if exists {
+			var ownership *s3.GetBucketOwnershipControlsOutput
+			err = b.withRetry(ctx, func(ctx context.Context) error {
+				var err error
+				ownership, err = awsS3.GetBucketOwnershipControlsWithContext(ctx, &s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucket)})
+				return err
+			})
+			switch {
+			case awsErrorCode(err) == "OwnershipControlsNotFoundError":
+				needOwnership = true
+			case awsErrorCode(err) == "NotImplemented":
+			case err != nil:
+				return nil, s3Error("reading object ownership controls", err)
+			default:
+				needOwnership = true
+				for _, rule := range ownership.OwnershipControls.Rules {
+					switch aws.StringValue(rule.ObjectOwnership) {
+					case s3.ObjectOwnershipBucketOwnerPreferred, s3.ObjectOwnershipObjectWriter:
+						needOwnership = false
+					}
+				}
+			}
+		}
+		if needOwnership {
+			setup.add(fmt.Sprintf("enable ACLs for bucket %q (object ownership %s)", bucket, s3.ObjectOwnershipBucketOwnerPreferred), func() error {
+				err := b.withRetry(ctx, func(ctx context.Context) error {
+					_, err := awsS3.PutBucketOwnershipControlsWithContext(ctx, &s3.PutBucketOwnershipControlsInput{
+						Bucket: aws.String(bucket),
+						OwnershipControls: &s3.OwnershipControls{
+							Rules: []*s3.OwnershipControlsRule{
+								{ObjectOwnership: aws.String(s3.ObjectOwnershipBucketOwnerPreferred)},
+							},
+						},
+					})
+					return err
+				})
+				// Some S3-compatible services don't have ownership controls
+				if awsErrorCode(err) == "NotImplemented" {
+					return nil
+				}
+				return err
+			})
+		}
+	}
+
+	// Public-read bucket policy
+	policy := fmt.Sprintf(s3PublicReadPolicy, bucket)
+	policyAction := "set"
+	if exists {
+		var current *s3.GetBucketPolicyOutput
+		err = b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			current, err = awsS3.GetBucketPolicyWithContext(ctx, &s3.GetBucketPolicyInput{Bucket: aws.String(bucket)})
+			return err
+		})
+		switch {
+		case awsErrorCode(err) == "NoSuchBucketPolicy":
+		case err != nil:
+			return nil, s3Error("reading bucket policy", err)
+		case samePolicy(aws.StringValue(current.Policy), policy):
+			policyAction = ""
+		default:
+			policyAction = "replace"
+		}
+	}
+	if policyAction != "" {
+		setup.add(fmt.Sprintf("%s bucket policy for bucket %q to allow public reads", policyAction, bucket), func() error {
+			return b.withRetry(ctx, func(ctx context.Context) error {
+				_, err := awsS3.PutBucketPolicyWithContext(ctx, &s3.PutBucketPolicyInput{
+					Bucket: aws.String(bucket),
+					Policy: aws.String(policy),
+				})
+				return err
+			})
+		})
+	}
+
+	if opts.IAMUser != "" {
+		err = b.setupIAMUser(ctx, iam.New(awsSession), opts.IAMUser, setup)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return setup, nil
+}
+
+// setupIAMUser adds the changes needed to create IAM user name (if
+// missing) and grant it write access to the bucket to setup
+func (b *s3Backend) setupIAMUser(ctx context.Context, awsIAM *iam.IAM, name string, setup *Setup) error {
+	err := b.withRetry(ctx, func(ctx context.Context) error {
+		_, err := awsIAM.GetUserWithContext(ctx, &iam.GetUserInput{UserName: aws.String(name)})
+		return err
+	})
+	exists := true
+	if err != nil {
+		if awsErrorCode(err) != iam.ErrCodeNoSuchEntityException {
+			return fmt.Errorf("reading IAM user %q failed: %s", name, err)
+		}
+		exists = false
+		setup.add(fmt.Sprintf("create IAM user %q", name), func() error {
+			return b.withRetry(ctx, func(ctx context.Context) error {
+				_, err := awsIAM.CreateUserWithContext(ctx, &iam.CreateUserInput{UserName: aws.String(name)})
+				return err
+			})
+		})
+	}
+
+	policyName := "usher-write-" + b.bucket()
+	policy := fmt.Sprintf(s3WritePolicy, b.bucket())
+	if exists {
+		var current *iam.GetUserPolicyOutput
+		err = b.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			current, err = awsIAM.GetUserPolicyWithContext(ctx, &iam.GetUserPolicyInput{
+				UserName:   aws.String(name),
+				PolicyName: aws.String(policyName),
+			})
+			return err
+		})
+		switch {
+		case awsErrorCode(err) == iam.ErrCodeNoSuchEntityException:
+		case err != nil:
+			return fmt.Errorf("reading IAM user policy %q failed: %s", policyName, err)
+		default:
+			// IAM returns policy documents url-encoded
+			document, err := url.QueryUnescape(aws.StringValue(current.PolicyDocument))
+			if err == nil && samePolicy(document, policy) {
+				return nil
+			}
+		}
+	}
+	setup.add(fmt.Sprintf("set IAM user policy %q for %q, allowing writes to bucket %q", policyName, name, b.bucket()), func() error {
+		return b.withRetry(ctx, func(ctx context.Context) error {
+			_, err := awsIAM.PutUserPolicyWithContext(ctx, &iam.PutUserPolicyInput{
+				UserName:       aws.String(name),
+				PolicyName:     aws.String(policyName),
+				PolicyDocument: aws.String(policy),
+			})
+			return err
+		})
+	})
 	return nil
 }
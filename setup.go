@@ -0,0 +1,75 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for setting up backend infrastructure
+(e.g. buckets and access policies), used by `usher setup`. Setup is
+planned first, as a list of changes that can be shown to the user for
+confirmation, and then applied. Backends support setup by implementing
+the BackendSetup interface, and should only plan changes that are
+actually needed, so setup is safe to re-run.
+*/
+
+package usher
+
+import (
+	"fmt"
+)
+
+// SetupOptions are optional settings for Setup
+type SetupOptions struct {
+	IAMUser string // IAM user to grant write access to (s3)
+}
+
+// SetupChange is a single change planned by a backend setup
+type SetupChange struct {
+	Description string
+	apply       func() error
+}
+
+// Setup is the list of changes needed to set up a backend
+type Setup struct {
+	Changes []SetupChange
+}
+
+// add appends a change with description and apply function to setup
+func (setup *Setup) add(description string, apply func() error) {
+	setup.Changes = append(setup.Changes, SetupChange{Description: description, apply: apply})
+}
+
+// Apply makes the changes in setup in order, stopping at the first error
+func (setup *Setup) Apply() error {
+	for _, change := range setup.Changes {
+		err := change.apply()
+		if err != nil {
+			return fmt.Errorf("%s: %w", change.Description, err)
+		}
+	}
+	return nil
+}
+
+// BackendSetup is implemented by backends that can set up their own
+// infrastructure
+type BackendSetup interface {
+	Setup(opts SetupOptions) (*Setup, error)
+}
+
+// Setup returns the changes needed to set up the infrastructure for the
+// configured backend, which must be of type backendType
+func (db *DB) Setup(backendType string, opts SetupOptions) (*Setup, error) {
+	config, err := db.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Type != backendType {
+		return nil, fmt.Errorf("config backend type for %q is %q, not %q", db.Domain, config.Type, backendType)
+	}
+	backend, err := db.backend(config)
+	if err != nil {
+		return nil, err
+	}
+	setup, ok := backend.(BackendSetup)
+	if !ok {
+		return nil, fmt.Errorf("%s backend does not support setup", backendType)
+	}
+	return setup.Setup(opts)
+}
@@ -0,0 +1,162 @@
+/*
+usher-backend-file is a reference usher exec backend, which publishes
+mappings to a local JSON file. It's used by the usher tests, and is a
+starting point for writing your own backends - see Exec.md.
+
+Options:
+  path: the JSON file to publish mappings to (required)
+  fail: a list of codes whose pushes should fail (for testing)
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const protocolVersion = 1
+
+type request struct {
+	Protocol int                    `json:"protocol"`
+	Op       string                 `json:"op"`
+	Domain   string                 `json:"domain"`
+	Options  map[string]interface{} `json:"options"`
+	Mappings map[string]string      `json:"mappings"`
+	Prune    bool                   `json:"prune"`
+}
+
+type result struct {
+	Code   string `json:"code"`
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type response struct {
+	Protocol     int               `json:"protocol"`
+	Name         string            `json:"name,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Mappings     map[string]string `json:"mappings,omitempty"`
+	Results      []result          `json:"results,omitempty"`
+}
+
+func main() {
+	var req request
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid request: %s\n", err)
+		os.Exit(2)
+	}
+
+	resp := handle(&req)
+	resp.Protocol = protocolVersion
+	err = json.NewEncoder(os.Stdout).Encode(resp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func handle(req *request) response {
+	if req.Protocol != protocolVersion {
+		return response{Error: fmt.Sprintf("unsupported protocol version %d", req.Protocol)}
+	}
+
+	path, _ := req.Options["path"].(string)
+	switch req.Op {
+	case "handshake":
+		// No "plan" capability - usher plans by diffing against pull
+		return response{Name: "file", Capabilities: []string{"validate", "push", "pull"}}
+
+	case "validate":
+		if path == "" {
+			return response{Error: "'path' option is required"}
+		}
+		return response{}
+
+	case "pull":
+		current, err := readMappings(path)
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		return response{Mappings: current}
+
+	case "push":
+		current, err := readMappings(path)
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		fail := make(map[string]bool)
+		if codes, ok := req.Options["fail"].([]interface{}); ok {
+			for _, code := range codes {
+				fail[fmt.Sprint(code)] = true
+			}
+		}
+
+		var resp response
+		codes := make([]string, 0, len(req.Mappings))
+		for code := range req.Mappings {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		published := make(map[string]string)
+		for _, code := range codes {
+			url := req.Mappings[code]
+			oldUrl, exists := current[code]
+			switch {
+			case fail[code]:
+				resp.Results = append(resp.Results, result{Code: code, Error: "failed by request"})
+				if exists {
+					published[code] = oldUrl
+				}
+				continue
+			case !exists:
+				resp.Results = append(resp.Results, result{Code: code, Action: "create"})
+			case oldUrl != url:
+				resp.Results = append(resp.Results, result{Code: code, Action: "update"})
+			default:
+				resp.Results = append(resp.Results, result{Code: code, Action: "unchanged"})
+			}
+			published[code] = url
+		}
+		for code, oldUrl := range current {
+			if _, exists := req.Mappings[code]; !exists {
+				if req.Prune {
+					resp.Results = append(resp.Results, result{Code: code, Action: "delete"})
+				} else {
+					published[code] = oldUrl
+				}
+			}
+		}
+
+		data, err := json.MarshalIndent(published, "", "  ")
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		return resp
+
+	default:
+		return response{Error: fmt.Sprintf("unsupported op %q", req.Op)}
+	}
+}
+
+func readMappings(path string) (map[string]string, error) {
+	mappings := make(map[string]string)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mappings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &mappings)
+	return mappings, err
+}
@@ -0,0 +1,14 @@
+-- MySQL dump 10.13
+DROP TABLE IF EXISTS `yourls_url`;
+CREATE TABLE `yourls_url` (
+  `keyword` varchar(100) NOT NULL,
+  `url` text NOT NULL,
+  `title` text,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `ip` varchar(41) NOT NULL,
+  `clicks` int(10) unsigned NOT NULL,
+  PRIMARY KEY (`keyword`)
+);
+LOCK TABLES `yourls_url` WRITE;
+INSERT INTO `yourls_url` VALUES ('ozh','http://ozh.org/','Ozh\'s blog','2020-01-02 03:04:05','127.0.0.1',12),('yourls','https://yourls.org/','YOURLS, it''s yours','2020-02-03 04:05:06','127.0.0.1',3),('notitle','https://example.com/a,b',NULL,'2020-03-04 05:06:07','127.0.0.1',0);
+UNLOCK TABLES;
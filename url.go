@@ -0,0 +1,293 @@
+/*
+usher is a tiny personal url shortener.
+
+This file contains functions for validating and (optionally)
+normalising the urls we map codes to, and for applying the url
+rewrite rules (tracking parameter stripping and UTM injection)
+configured for a domain.
+*/
+
+package usher
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// defaultSchemes are the url schemes allowed if config does not specify any
+var defaultSchemes = []string{"http", "https"}
+
+// defaultPorts are stripped from urls during normalisation
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// Trailing slash policies
+const (
+	TrailingSlashKeep  = ""
+	TrailingSlashAdd   = "add"
+	TrailingSlashStrip = "strip"
+)
+
+// urlPolicy bundles the config and blocklists used to check urls
+type urlPolicy struct {
+	config    *ConfigEntry
+	blocklist *Blocklist
+}
+
+// apply strips tracking parameters from url (always), validates and
+// normalises it using the url policy in p.config (unless force is
+// set), and checks it against the host policies and blocklists (always)
+func (p *urlPolicy) apply(url string, force bool) (string, error) {
+	var err error
+	url = p.config.stripUrlParams(url)
+	if !force {
+		url, err = p.config.checkUrl(url)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = p.config.checkHost(url)
+	if err != nil {
+		return "", err
+	}
+	err = p.blocklist.checkUrl(url)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// checkUrl validates rawurl against the url policy in config, and
+// returns it, normalised if config.NormaliseUrls is set. Errors
+// returned wrap ErrUrlBad.
+func (config *ConfigEntry) checkUrl(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse url %q: %w", rawurl, ErrUrlBad)
+	}
+	if u.Scheme == "" {
+		return "", fmt.Errorf("url %q is not absolute: %w", rawurl, ErrUrlBad)
+	}
+
+	// Check scheme against allowlist
+	schemes := config.Schemes
+	if len(schemes) == 0 {
+		schemes = defaultSchemes
+	}
+	allowed := false
+	for _, scheme := range schemes {
+		if strings.ToLower(scheme) == u.Scheme {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("url %q has disallowed scheme %q (allowed: %s): %w",
+			rawurl, u.Scheme, strings.Join(schemes, ", "), ErrUrlBad)
+	}
+
+	// Opaque urls (e.g. mailto:) have no host to check
+	if u.Opaque != "" {
+		return rawurl, nil
+	}
+
+	// Check host
+	hostname := u.Hostname()
+	if hostname == "" {
+		return "", fmt.Errorf("url %q has no host: %w", rawurl, ErrUrlBad)
+	}
+	isIP := net.ParseIP(hostname) != nil
+	if !isIP && !validHostname(hostname) {
+		return "", fmt.Errorf("url %q has invalid host %q: %w", rawurl, hostname, ErrUrlBad)
+	}
+	port := u.Port()
+	if strings.HasSuffix(u.Host, ":") {
+		return "", fmt.Errorf("url %q has empty port: %w", rawurl, ErrUrlBad)
+	}
+
+	if !config.NormaliseUrls {
+		return rawurl, nil
+	}
+
+	// Normalise host (lowercased and punycoded, or just lowercased if
+	// it isn't a valid IDNA name e.g. has underscores) and port
+	host := strings.ToLower(hostname)
+	if !isIP {
+		if ascii, err := idna.Lookup.ToASCII(hostname); err == nil {
+			host = ascii
+		}
+	}
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	// Apply trailing slash policy
+	switch config.TrailingSlash {
+	case TrailingSlashKeep:
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+			if u.RawPath != "" {
+				u.RawPath += "/"
+			}
+		}
+	case TrailingSlashStrip:
+		if u.Path == "" {
+			u.Path = "/"
+		} else if u.Path != "/" && strings.HasSuffix(u.Path, "/") {
+			u.Path = strings.TrimSuffix(u.Path, "/")
+			u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+		}
+	default:
+		return "", fmt.Errorf("invalid trailing_slash policy %q in config", config.TrailingSlash)
+	}
+
+	return u.String(), nil
+}
+
+// validHostname returns true if hostname is dot-separated labels of
+// letters, digits, hyphens and underscores (with an optional trailing
+// dot). This is deliberately lenient - hosts in use don't all follow
+// the stricter IDNA and STD3 rules.
+func validHostname(hostname string) bool {
+	hostname = strings.TrimSuffix(hostname, ".")
+	if hostname == "" {
+		return false
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" {
+			return false
+		}
+		for _, r := range label {
+			if r != '-' && r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripUrlParams returns rawurl with any query parameters matching
+// config.StripParams removed. Unparseable urls are returned as-is.
+func (config *ConfigEntry) stripUrlParams(rawurl string) string {
+	if len(config.StripParams) == 0 {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rawurl
+	}
+	u.RawQuery = stripParams(u.RawQuery, config.StripParams)
+	return u.String()
+}
+
+// urlKey returns a normalised form of rawurl for comparisons, with
+// scheme and host lowercased, host punycoded, default ports stripped,
+// and an empty path set to "/". Unparseable urls are returned as-is.
+func urlKey(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Opaque != "" || u.Host == "" {
+		return rawurl
+	}
+
+	host := normaliseHost(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = host + ":" + port
+	}
+	u.Host = host
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// stripParams returns rawQuery with any parameters matching the glob
+// patterns in strip removed. The order of other parameters is preserved.
+func stripParams(rawQuery string, strip []string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key := param
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			key = param[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		matched := false
+		for _, pattern := range strip {
+			if ok, _ := path.Match(pattern, key); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// addUTM returns rawurl with the UTM parameters configured in utm
+// appended, expanding `{code}` and `{domain}` placeholders. Parameters
+// already present in rawurl are left alone, as are non-http(s) urls.
+func (utm *UTMConfig) addUTM(rawurl, domain, code string) string {
+	if utm == nil {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return rawurl
+	}
+
+	expander := strings.NewReplacer("{code}", code, "{domain}", domain)
+	query := u.Query()
+	var params []string
+	for _, p := range []struct{ key, value string }{
+		{"utm_source", utm.Source},
+		{"utm_medium", utm.Medium},
+		{"utm_campaign", utm.Campaign},
+		{"utm_term", utm.Term},
+		{"utm_content", utm.Content},
+	} {
+		if p.value == "" {
+			continue
+		}
+		if _, exists := query[p.key]; exists {
+			continue
+		}
+		params = append(params,
+			p.key+"="+url.QueryEscape(expander.Replace(p.value)))
+	}
+	if len(params) == 0 {
+		return rawurl
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += strings.Join(params, "&")
+	return u.String()
+}
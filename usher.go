@@ -23,6 +23,10 @@ import (
 	yaml "gopkg.in/yaml.v3"
 )
 
+// Version is the usher version, recorded in published objects where
+// supported. Release builds set it with -ldflags "-X github.com/gavincarr/usher.Version=..."
+var Version = "devel"
+
 const configfile = "usher.yml"
 const indexCode = "INDEX"
 
@@ -37,6 +41,11 @@ var (
 	ErrNotFound             = errors.New("not found")
 	ErrCodeExists           = errors.New("code already used")
 	ErrNoChange             = errors.New("mapping unchanged")
+	ErrCodeBad              = errors.New("code is invalid")
+	ErrUrlBad               = errors.New("url is invalid")
+	ErrHostDenied           = errors.New("url host denied by policy")
+	ErrHostBlocked          = errors.New("url host is blocklisted")
+	ErrIndexPrivate         = errors.New("INDEX is served at / and cannot be private")
 	ErrPushTypeUnconfigured = errors.New("config backend type is unconfigured")
 	ErrPushTypeBad          = errors.New("config backend type is bad")
 )
@@ -48,16 +57,107 @@ type DB struct {
 	ConfigPath string // full path to usher config file
 }
 
+// Entry is a single database mapping. Entries with only a Url are
+// stored in the database in the simple `code: url` form, and entries
+// with additional attributes as a `code: { url: ..., title: ... }` map.
 type Entry struct {
-	Code string
-	Url  string
+	Code    string    `yaml:"-" json:"code"`
+	Url     string    `yaml:"url" json:"url"`
+	Title   string    `yaml:"title,omitempty" json:"title,omitempty"`
+	Tags    []string  `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Created time.Time `yaml:"created,omitempty" json:"created,omitempty"`
+	Clicks  int       `yaml:"clicks,omitempty" json:"clicks,omitempty"`   // imported click count
+	Private bool      `yaml:"private,omitempty" json:"private,omitempty"` // never exported or listed publicly
+}
+
+// entryAttrs is an alias type for Entry without the yaml methods,
+// for use by them
+type entryAttrs Entry
+
+// MarshalYAML marshals entries with only a url as a simple string,
+// and entries with other attributes as a map
+func (e Entry) MarshalYAML() (interface{}, error) {
+	if e.Title == "" && len(e.Tags) == 0 && e.Created.IsZero() && e.Clicks == 0 && !e.Private {
+		return e.Url, nil
+	}
+	return entryAttrs(e), nil
+}
+
+// UnmarshalYAML unmarshals entries from either a simple url string
+// or a map of attributes
+func (e *Entry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&e.Url)
+	}
+	return value.Decode((*entryAttrs)(e))
 }
 
+// ConfigEntry is the config for a single domain. Settings used by all
+// backends are fields here, and any other keys are collected in Options
+// for the configured backend to decode (see ConfigEntry.DecodeOptions).
 type ConfigEntry struct {
-	Type      string `yaml:"type"`
-	AWSKey    string `yaml:"aws_key,omitempty"`
-	AWSSecret string `yaml:"aws_secret,omitempty"`
-	AWSRegion string `yaml:"aws_region,omitempty"`
+	Type string `yaml:"type"`
+	// Url policy settings
+	Schemes       []string `yaml:"schemes,omitempty"`        // allowed url schemes (default: http, https)
+	NormaliseUrls bool     `yaml:"normalise_urls,omitempty"` // normalise urls on add/update
+	TrailingSlash string   `yaml:"trailing_slash,omitempty"` // trailing slash policy ("add" or "strip")
+	// Url rewrite settings
+	StripParams []string   `yaml:"strip_params,omitempty"` // query parameter globs to strip on add/update
+	UTM         *UTMConfig `yaml:"utm,omitempty"`          // utm parameters to append on push
+	// Destination host policy settings
+	AllowHosts []string `yaml:"allow_hosts,omitempty"` // if set, url hosts must match one of these
+	DenyHosts  []string `yaml:"deny_hosts,omitempty"`  // url hosts must not match any of these
+	// Backend options
+	Options map[string]interface{} `yaml:",inline"`
+}
+
+// UTMConfig holds UTM parameter values to be appended to urls on push.
+// Values may include `{code}` and `{domain}` placeholders.
+type UTMConfig struct {
+	Source   string `yaml:"source,omitempty"`
+	Medium   string `yaml:"medium,omitempty"`
+	Campaign string `yaml:"campaign,omitempty"`
+	Term     string `yaml:"term,omitempty"`
+	Content  string `yaml:"content,omitempty"`
+}
+
+// Visibility filters on entries' private flag in ListWithOptions
+type Visibility int
+
+const (
+	ListAll     Visibility = iota // list all entries
+	ListPublic                    // list only public entries
+	ListPrivate                   // list only private entries
+)
+
+// ListOptions are optional settings for ListWithOptions
+type ListOptions struct {
+	Glob       string     // code glob (currently ignored)
+	Visibility Visibility // private flag filter
+}
+
+// AddOptions are optional settings for AddWithOptions
+type AddOptions struct {
+	Force   bool      // skip url validation and normalisation
+	New     bool      // always generate a new random code, even if url is already mapped
+	Title   string    // entry title
+	Tags    []string  // entry tags
+	Private bool      // mark entry private
+	Created time.Time // entry created time, if known (e.g. for imports)
+	Clicks  int       // entry click count, if known (e.g. for imports)
+}
+
+// SetOptions are the entry attributes to change in Set. Nil fields
+// are left unchanged.
+type SetOptions struct {
+	Title   *string
+	Tags    []string // an empty non-nil slice clears tags
+	Private *bool
+}
+
+// UpdateOptions are optional settings for UpdateWithOptions
+type UpdateOptions struct {
+	Force bool // skip url validation and normalisation
 }
 
 // NewDB creates a DB struct with members derived from parameters,
@@ -168,6 +268,12 @@ func (db *DB) Init() (dbCreated bool, err error) {
 
 // List returns the set of database entries whose code matches glob
 func (db *DB) List(glob string) ([]Entry, error) {
+	return db.ListWithOptions(ListOptions{Glob: glob})
+}
+
+// ListWithOptions returns the set of database entries matching opts,
+// sorted by code
+func (db *DB) ListWithOptions(opts ListOptions) ([]Entry, error) {
 	// FIXME: first-pass - ignore glob
 	mappings, err := db.readDB()
 	if err != nil {
@@ -175,176 +281,167 @@ func (db *DB) List(glob string) ([]Entry, error) {
 	}
 
 	// Extract codes and sort
-	codes := make([]string, len(mappings))
-	i := 0
-	for code := range mappings {
-		codes[i] = code
-		i++
+	codes := make([]string, 0, len(mappings))
+	for code, entry := range mappings {
+		if opts.includes(entry) {
+			codes = append(codes, code)
+		}
 	}
 	sort.Strings(codes)
 
 	// Compile entries
-	var entries = make([]Entry, len(mappings))
-	i = 0
-	for _, code := range codes {
-		entries[i] = Entry{Code: code, Url: mappings[code]}
-		i++
+	var entries = make([]Entry, len(codes))
+	for i, code := range codes {
+		entries[i] = *mappings[code]
 	}
 
 	return entries, nil
 }
 
-// Add a mapping for url and code to the database.
-// If code is missing, a random code will be generated and returned.
-func (db *DB) Add(url, code string) (string, error) {
-	mappings, err := db.readDB()
-	if err != nil {
-		return "", err
+// includes returns true if entry passes the filters in opts
+func (opts ListOptions) includes(entry *Entry) bool {
+	switch opts.Visibility {
+	case ListPublic:
+		return !entry.Private
+	case ListPrivate:
+		return entry.Private
 	}
+	return true
+}
 
-	if code == "" {
-		code = randomCode(mappings)
-
-	} else {
-		// Check for parameter inversion
-		reUrl := regexp.MustCompile(`^https?://`)
-		if !reUrl.MatchString(url) && reUrl.MatchString(code) {
-			url, code = code, url
-		}
-
-		// Check whether code is already used
-		dburl, exists := mappings[code]
-		if exists {
-			if dburl == url {
-				// Trying to re-add the same url is not an error, just a noop
-				return code, nil
-			}
-			return code, ErrCodeExists
-		}
-	}
+// Add a mapping for url and code to the database.
+// If code is missing, the code of any existing mapping for url will be
+// returned, or else a random code will be generated and returned.
+func (db *DB) Add(url, code string) (string, error) {
+	code, _, err := db.AddWithOptions(url, code, AddOptions{})
+	return code, err
+}
 
-	mappings[code] = url
-	err = db.writeDB(mappings)
-	if err != nil {
-		return code, err
-	}
+// AddWithOptions adds a mapping for url and code to the database,
+// using the settings in opts. If code is missing, the code of any
+// existing mapping for url with the same visibility is returned
+// (unless opts.New is set), or else a random code will be generated
+// and returned. Also returns true if no mapping was added because url
+// was already mapped (to code, if given).
+func (db *DB) AddWithOptions(url, code string, opts AddOptions) (string, bool, error) {
+	existing := false
+	err := db.Batch(func(tx *Tx) error {
+		var err error
+		code, existing, err = tx.Add(url, code, opts)
+		return err
+	})
+	return code, existing, err
+}
 
-	return code, nil
+// Set changes the attributes in opts for the mapping with code.
+// Returns ErrNotFound if code does not exist.
+func (db *DB) Set(code string, opts SetOptions) error {
+	return db.Batch(func(tx *Tx) error {
+		return tx.Set(code, opts)
+	})
 }
 
 // Update an existing mapping in the database, changing the URL.
 func (db *DB) Update(url, code string) error {
-	mappings, err := db.readDB()
-	if err != nil {
-		return err
-	}
-
-	// Check for parameter inversion
-	reUrl := regexp.MustCompile(`^https?://`)
-	if !reUrl.MatchString(url) && reUrl.MatchString(code) {
-		url, code = code, url
-	}
-
-	// If code is missing, abort
-	dburl, exists := mappings[code]
-	if !exists {
-		return ErrNotFound
-	}
-
-	// Trying to update to the same url is not an error, just a noop
-	if dburl == url {
-		return nil
-	}
-
-	mappings[code] = url
-	err = db.writeDB(mappings)
-	if err != nil {
-		return err
-	}
+	return db.UpdateWithOptions(url, code, UpdateOptions{})
+}
 
-	return nil
+// UpdateWithOptions updates an existing mapping in the database,
+// changing the URL, using the settings in opts.
+func (db *DB) UpdateWithOptions(url, code string, opts UpdateOptions) error {
+	return db.Batch(func(tx *Tx) error {
+		return tx.Update(url, code, opts)
+	})
 }
 
 // Remove the mapping with code from the database
 // Returns ErrNotFound if code does not exist in the database
 func (db *DB) Remove(code string) error {
-	mappings, err := db.readDB()
-	if err != nil {
-		return err
-	}
-
-	_, exists := mappings[code]
-	if !exists {
-		return ErrNotFound
-	}
+	return db.Batch(func(tx *Tx) error {
+		return tx.Remove(code)
+	})
+}
 
-	delete(mappings, code)
+// Push syncs all current mappings with the backend configured for db.Domain
+// in db.ConfigPath
+func (db *DB) Push() error {
+	_, err := db.PushWithOptions(PushOptions{})
+	return err
+}
 
-	err = db.writeDB(mappings)
+// PushWithOptions syncs all current mappings with the backend configured
+// for db.Domain in db.ConfigPath, using the settings in opts, and
+// returns the changes made
+func (db *DB) PushWithOptions(opts PushOptions) (*Plan, error) {
+	backend, mappings, err := db.preparePush()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return backend.Push(mappings, opts)
 }
 
-// Push syncs all current mappings with the backend configured for db.Domain
-// in db.ConfigPath
-func (db *DB) Push() error {
+// preparePush is a utility function to return the configured backend
+// for db.Domain, and the mappings to push to it, after checking all
+// mappings against host policies
+func (db *DB) preparePush() (Backend, map[string]string, error) {
 	config, err := db.readConfig()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	if config.Type == "" {
-		return fmt.Errorf("no 'type' field found for %q in config %q\n",
-			db.Domain, db.ConfigPath)
+	backend, err := db.backend(config)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	switch config.Type {
-	case "s3":
-		err = db.pushS3(config)
-		if err != nil {
-			return err
-		}
-	case "render":
-		err = db.pushRender()
-		if err != nil {
-			return err
-		}
-	case "unconfigured":
-		return ErrPushTypeUnconfigured
-	default:
-		return fmt.Errorf("invalid config backend type %q found for %q: %w",
-			config.Type, db.Domain, ErrPushTypeBad)
+	// Check all mappings against host policies before pushing anything
+	entries, err := db.readDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = config.checkHosts(urlMappings(entries))
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry, exists := entries[indexCode]; exists && entry.Private {
+		return nil, nil, ErrIndexPrivate
 	}
 
-	return nil
+	return backend, db.pushMappings(config, entries), nil
 }
 
 // readDB is a utility function to read all mappings from db.DBPath
-// and return as a go map
-func (db *DB) readDB() (map[string]string, error) {
+// and return as a go map of code => entry
+func (db *DB) readDB() (map[string]*Entry, error) {
 	data, err := ioutil.ReadFile(db.DBPath)
 	if err != nil {
 		return nil, err
 	}
 
-	var mappings map[string]string
+	var mappings map[string]*Entry
 	err = yaml.Unmarshal(data, &mappings)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(mappings) == 0 {
-		mappings = make(map[string]string)
+	// Key mappings by NFC-normalised code, so lookups match codes as
+	// normalised by NormaliseCode
+	normalised := make(map[string]*Entry, len(mappings))
+	for code, entry := range mappings {
+		if entry == nil {
+			return nil, fmt.Errorf("missing url for code %q in database %q", code, db.DBPath)
+		}
+		entry.Code = NormaliseCode(code)
+		if _, exists := normalised[entry.Code]; exists {
+			return nil, fmt.Errorf("duplicate code %q (in Unicode NFC form) in database %q", entry.Code, db.DBPath)
+		}
+		normalised[entry.Code] = entry
 	}
 
-	return mappings, nil
+	return normalised, nil
 }
 
 // writeDB is a utility function to write mappings (as yaml) to db.DBPath
-func (db *DB) writeDB(mappings map[string]string) error {
+func (db *DB) writeDB(mappings map[string]*Entry) error {
 	var data []byte
 	var err error
 	if len(mappings) > 0 {
@@ -364,9 +461,37 @@ func (db *DB) writeDB(mappings map[string]string) error {
 		return err
 	}
 
+	// Invalidate any cached reverse index (ignoring errors, since
+	// stale indexes are also detected on read)
+	os.Remove(db.indexPath())
+
 	return nil
 }
 
+// pushMappings is a utility function to convert entries to a map of
+// code => url for pushing to a backend, applying any push-time url
+// rewrites from config
+func (db *DB) pushMappings(config *ConfigEntry, entries map[string]*Entry) map[string]string {
+	mappings := urlMappings(entries)
+	if config.UTM != nil {
+		for code, url := range mappings {
+			mappings[code] = config.UTM.addUTM(url, db.Domain, code)
+		}
+	}
+
+	return mappings
+}
+
+// urlMappings is a utility function to convert a map of code => entry
+// to a simple map of code => url
+func urlMappings(mappings map[string]*Entry) map[string]string {
+	urls := make(map[string]string, len(mappings))
+	for code, entry := range mappings {
+		urls[code] = entry.Url
+	}
+	return urls
+}
+
 // readConfig is a utility function to read the config entry for
 // db.Domain from db.ConfigPath file
 func (db *DB) readConfig() (*ConfigEntry, error) {
@@ -389,6 +514,31 @@ func (db *DB) readConfig() (*ConfigEntry, error) {
 	return &entry, nil
 }
 
+// readPolicyConfig is a utility function to read the config entry for
+// db.Domain for url policy checks. A missing config file or entry is not
+// an error, and just returns an empty ConfigEntry (i.e. default policies).
+func (db *DB) readPolicyConfig() (*ConfigEntry, error) {
+	config, err := db.readConfig()
+	if err == ErrNotFound || os.IsNotExist(err) {
+		return &ConfigEntry{}, nil
+	}
+	return config, err
+}
+
+// readUrlPolicy is a utility function to read the url policy config
+// and blocklists for db.Domain
+func (db *DB) readUrlPolicy() (*urlPolicy, error) {
+	config, err := db.readPolicyConfig()
+	if err != nil {
+		return nil, err
+	}
+	blocklist, err := db.LoadBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	return &urlPolicy{config: config, blocklist: blocklist}, nil
+}
+
 // writeConfigString is a utility function to write data to db.ConfigPath
 func (db *DB) writeConfigString(data string) error {
 	tmpfile := db.ConfigPath + ".tmp"
@@ -432,7 +582,7 @@ func (db *DB) appendConfigString(data string) error {
 // lowercase ascii characters. This usually allows them to be
 // relatively easily distinguished from explicit codes, while
 // still being easy to communicate orally.
-func randomCode(mappings map[string]string) string {
+func randomCode(mappings map[string]*Entry) string {
 	rand.Seed(time.Now().UnixNano())
 	var b strings.Builder
 	b.WriteByte(digits[rand.Intn(len(digits))])
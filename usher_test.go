@@ -3,10 +3,28 @@
 package usher
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/udhos/equalfile"
@@ -21,6 +39,14 @@ const (
 	dbfile           = "example.me.yml"
 )
 
+// testNow is the current time in tests, recorded as the creation time
+// of added entries
+var testNow = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func init() {
+	timeNow = func() time.Time { return testNow }
+}
+
 // TestBasic runs integration tests from an existing root directory
 func TestBasic(t *testing.T) {
 	cwd, err := os.Getwd()
@@ -325,3 +351,2403 @@ func doSetupNew(t *testing.T, cwd string) {
 		t.Fatal(err)
 	}
 }
+
+// TestUnicodeCodes checks normalisation and validation of non-ascii codes
+func TestUnicodeCodes(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	// Precomposed and decomposed forms of the same code should collide
+	precomposed := "caf\u00e9"
+	decomposed := "cafe\u0301"
+	code, err := db.Add("https://example.com/cafe", decomposed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, precomposed, code, "Add() returns NFC-normalised code")
+	_, err = db.Add("https://example.com/other", precomposed)
+	assert.Equal(t, ErrCodeExists, err, "Add() of precomposed code collides with decomposed one")
+	err = db.Update("https://example.com/cafe2", decomposed)
+	assert.Nil(t, err, "Update() with decomposed code finds precomposed entry")
+
+	// Decomposed codes already in the database are normalised on read
+	data, err := ioutil.ReadFile(db.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(db.DBPath, []byte(decomposed+": https://example.com/cafe\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/other", precomposed)
+	assert.Equal(t, ErrCodeExists, err, "Add() of precomposed code collides with decomposed database key")
+	err = db.Remove(precomposed)
+	assert.Nil(t, err, "Remove() of precomposed code finds decomposed database key")
+	testList(t, db, []string{})
+	err = ioutil.WriteFile(db.DBPath, []byte(decomposed+": https://example.com/a\n"+precomposed+": https://example.com/b\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.List("")
+	assert.Error(t, err, "database with codes that collide in NFC form")
+	err = ioutil.WriteFile(db.DBPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Single-script, CJK and emoji codes are fine
+	for _, code := range []string{"привет", "日本語テキスト", "한국어", "🚀", "\U0001f469\u200d\U0001f4bb", "test-1"} {
+		_, err = db.Add("https://example.com/"+code, code)
+		assert.Nil(t, err, "Add() of code %q", code)
+	}
+
+	// Mixed-script confusables, whitespace and invisible characters are rejected
+	for _, code := range []string{
+		"p\u0430ypal",  // Cyrillic 'а' in Latin word
+		"\u03bfk",      // Greek omicron + Latin k
+		"foo bar",      // whitespace
+		"foo\u200bbar", // zero-width space
+		"",
+	} {
+		err = checkCode(NormaliseCode(code))
+		if !errors.Is(err, ErrCodeBad) {
+			t.Errorf("checkCode(%q) returned %v, expected ErrCodeBad", code, err)
+		}
+	}
+
+	entries, err := db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, len(entries), "List() entry count")
+
+	// Render routes should be percent-encoded, S3 keys raw
+	assert.Equal(t, "/caf%C3%A9", codePath(precomposed))
+	assert.Equal(t, "/test-1", codePath("test-1"))
+}
+
+// testReadUrls is a utility function to read the current db mappings
+// as a map of code => url
+func testReadUrls(t *testing.T, db *DB) map[string]string {
+	mappings, err := db.readDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return urlMappings(mappings)
+}
+
+// doSetupTemp is a utility function to create a DB in a new temporary root
+// directory for testing. Callers are responsible for removing db.Root.
+func doSetupTemp(t *testing.T) *DB {
+	root, err := ioutil.TempDir("", "usher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{
+		Root:       root,
+		Domain:     domain,
+		DBPath:     filepath.Join(root, dbfile),
+		ConfigPath: filepath.Join(root, configfile),
+	}
+	_, err = db.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestCheckUrl checks url validation and normalisation
+func TestCheckUrl(t *testing.T) {
+	tests := []struct {
+		config ConfigEntry
+		url    string
+		want   string // empty if url is invalid
+	}{
+		{ConfigEntry{}, "https://example.com/foo", "https://example.com/foo"},
+		{ConfigEntry{}, "http://Example.COM:80", "http://Example.COM:80"},
+		{ConfigEntry{}, "/relative/path", ""},
+		{ConfigEntry{}, "example.com/foo", ""},
+		{ConfigEntry{}, "javascript:alert(1)", ""},
+		{ConfigEntry{}, "htps://example.com/", ""},
+		{ConfigEntry{}, "https:///foo", ""},
+		{ConfigEntry{}, "https://exa mple.com/", ""},
+		{ConfigEntry{}, "mailto:foo@example.com", ""},
+		{ConfigEntry{Schemes: []string{"https", "mailto"}}, "mailto:foo@example.com", "mailto:foo@example.com"},
+		{ConfigEntry{Schemes: []string{"https"}}, "http://example.com/", ""},
+		{ConfigEntry{}, "https://my_host.example.com/", "https://my_host.example.com/"},
+		{ConfigEntry{}, "https://ab--cd.example.com/", "https://ab--cd.example.com/"},
+		{ConfigEntry{}, "https://bücher.example/", "https://bücher.example/"},
+		{ConfigEntry{}, "https://example..com/", ""},
+		{ConfigEntry{}, "https://ex!ample.com/", ""},
+		{ConfigEntry{NormaliseUrls: true}, "HTTP://Example.COM:80", "http://example.com"},
+		{ConfigEntry{NormaliseUrls: true}, "https://My_Host.example.com/", "https://my_host.example.com/"},
+		{ConfigEntry{NormaliseUrls: true}, "https://AB--CD.example.com/", "https://ab--cd.example.com/"},
+		{ConfigEntry{NormaliseUrls: true}, "https://example.com?a=b", "https://example.com?a=b"},
+		{ConfigEntry{NormaliseUrls: true}, "https://example.com:443/a/?b=c#d", "https://example.com/a/?b=c#d"},
+		{ConfigEntry{NormaliseUrls: true}, "https://example.com:8443/a", "https://example.com:8443/a"},
+		{ConfigEntry{NormaliseUrls: true}, "https://bücher.example/", "https://xn--bcher-kva.example/"},
+		{ConfigEntry{NormaliseUrls: true}, "http://[::1]:80/", "http://[::1]/"},
+		{ConfigEntry{NormaliseUrls: true, TrailingSlash: "add"}, "https://example.com/a", "https://example.com/a/"},
+		{ConfigEntry{NormaliseUrls: true, TrailingSlash: "strip"}, "https://example.com/a/", "https://example.com/a"},
+		{ConfigEntry{NormaliseUrls: true, TrailingSlash: "strip"}, "https://example.com", "https://example.com/"},
+	}
+
+	for _, test := range tests {
+		got, err := test.config.checkUrl(test.url)
+		if test.want == "" {
+			if !errors.Is(err, ErrUrlBad) {
+				t.Errorf("checkUrl(%q) returned %q/%v, expected ErrUrlBad", test.url, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("checkUrl(%q) returned unexpected error: %s", test.url, err)
+			continue
+		}
+		assert.Equal(t, test.want, got, "checkUrl(%q)", test.url)
+	}
+
+	// Invalid urls are accepted by Add() if forced
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	_, err := db.Add("javascript:alert(1)", "bad")
+	if !errors.Is(err, ErrUrlBad) {
+		t.Errorf("Add() of invalid url returned %v, expected ErrUrlBad", err)
+	}
+	_, _, err = db.AddWithOptions("javascript:alert(1)", "bad", AddOptions{Force: true})
+	assert.Nil(t, err, "AddWithOptions() with Force")
+}
+
+// TestUrlRewrites checks tracking parameter stripping and UTM injection
+func TestUrlRewrites(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	err := db.writeConfigString(db.Domain + `:
+  type: render
+  schemes: [ http, https, mailto ]
+  strip_params: [ "utm_*", fbclid, gclid ]
+  utm:
+    source: usher
+    medium: shortlink
+    campaign: "{code}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tracking parameters are stripped on Add() and Update()
+	_, err = db.Add("https://example.com/a?x=1&utm_source=fb&fbclid=abc&y=2", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/b?gclid=abc&utm_medium=cpc", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/c?utm_campaign=spring", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update("https://example.com/c?utm_campaign=summer#top", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// including for forced adds, and urls without hosts
+	_, _, err = db.AddWithOptions("https://example.com/d?fbclid=abc&z=3", "d", AddOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("mailto:me@example.com?subject=hi&utm_source=fb", "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings := testReadUrls(t, db)
+	assert.Equal(t, map[string]string{
+		"a": "https://example.com/a?x=1&y=2",
+		"b": "https://example.com/b",
+		"c": "https://example.com/c#top",
+		"d": "https://example.com/d?z=3",
+		"m": "mailto:me@example.com?subject=hi",
+	}, mappings, "stored mappings are stripped")
+
+	// Push-time mappings carry UTM parameters
+	config, err := db.readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.readDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings = db.pushMappings(config, entries)
+	assert.Equal(t, map[string]string{
+		"a": "https://example.com/a?x=1&y=2&utm_source=usher&utm_medium=shortlink&utm_campaign=a",
+		"b": "https://example.com/b?utm_source=usher&utm_medium=shortlink&utm_campaign=b",
+		"c": "https://example.com/c?utm_source=usher&utm_medium=shortlink&utm_campaign=c#top",
+		"d": "https://example.com/d?z=3&utm_source=usher&utm_medium=shortlink&utm_campaign=d",
+		"m": "mailto:me@example.com?subject=hi",
+	}, mappings, "push mappings include utm parameters")
+
+	// Explicit UTM parameters are not overridden
+	utm := UTMConfig{Source: "usher", Campaign: "{domain}"}
+	assert.Equal(t, "https://example.com/?utm_source=news&utm_campaign=example.me",
+		utm.addUTM("https://example.com/?utm_source=news", db.Domain, "x"))
+}
+
+// TestHostPolicies checks allow_hosts/deny_hosts enforcement
+func TestHostPolicies(t *testing.T) {
+	config := ConfigEntry{
+		AllowHosts: []string{".example.com", "*.example.org", "example.net"},
+		DenyHosts:  []string{"evil.example.com", "*.test.example.org"},
+	}
+	tests := []struct {
+		url  string
+		rule string // matching rule expected in error, or empty if allowed
+	}{
+		{"https://example.com/", ""},
+		{"https://docs.example.com/", ""},
+		{"https://DOCS.Example.COM./", ""},
+		{"https://www.example.org/", ""},
+		{"https://example.net/", ""},
+		{"https://www.example.net/", "allow_hosts"},
+		{"https://notexample.com/", "allow_hosts"},
+		{"https://example.com.evil.io/", "allow_hosts"},
+		{"https://evil.example.com/", `"evil.example.com"`},
+		{"https://a.test.example.org/", `"*.test.example.org"`},
+		{"mailto:foo@example.com", "no host"},
+	}
+	for _, test := range tests {
+		err := config.checkHost(test.url)
+		if test.rule == "" {
+			assert.Nil(t, err, "checkHost(%q)", test.url)
+			continue
+		}
+		if !errors.Is(err, ErrHostDenied) {
+			t.Errorf("checkHost(%q) returned %v, expected ErrHostDenied", test.url, err)
+			continue
+		}
+		assert.Contains(t, err.Error(), test.rule, "checkHost(%q) error", test.url)
+	}
+
+	// Policies are enforced by Add(), Update(), and Push()
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	_, err := db.Add("https://external.io/", "ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeConfigString(db.Domain + `:
+  type: render
+  allow_hosts: [ .example.com ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.AddWithOptions("https://external.io/", "ext2", AddOptions{Force: true})
+	assert.True(t, errors.Is(err, ErrHostDenied), "Add() of denied host returns ErrHostDenied")
+	_, err = db.Add("https://www.example.com/", "ok")
+	assert.Nil(t, err, "Add() of allowed host")
+	err = db.Update("https://external.io/", "ok")
+	assert.True(t, errors.Is(err, ErrHostDenied), "Update() to denied host returns ErrHostDenied")
+	err = db.Push()
+	assert.True(t, errors.Is(err, ErrHostDenied), "Push() with denied host returns ErrHostDenied")
+	if err != nil {
+		assert.Contains(t, err.Error(), "ext: ", "Push() error names failing code")
+	}
+}
+
+// TestBlocklist checks blocklist loading, matching and auditing
+func TestBlocklist(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	// Add some mappings before installing any blocklists
+	for code, url := range map[string]string{
+		"ok":  "https://example.com/",
+		"bad": "https://www.bad.example.com/login",
+		"ph":  "https://phish.example.net/",
+	} {
+		_, err := db.Add(url, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Install blocklists
+	for _, name := range []string{"hosts.txt", "domains.txt", "adguard.txt"} {
+		count, err := db.RefreshBlocklist(name, filepath.Join(testDir, "blocklists", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, count > 0, "RefreshBlocklist(%q) count", name)
+	}
+	_, err := db.RefreshBlocklist("../evil", filepath.Join(testDir, "blocklists", "hosts.txt"))
+	assert.NotNil(t, err, "RefreshBlocklist() with bad name")
+	_, err = db.RefreshBlocklist("empty", filepath.Join(testGolden, "empty.yml"))
+	assert.NotNil(t, err, "RefreshBlocklist() with empty file")
+
+	blocklist, err := db.LoadBlocklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, blocklist.Len(), "blocklist length")
+	tests := []struct {
+		host string
+		list string // blocklist expected to match, or empty
+	}{
+		{"example.com", ""},
+		{"bad.example.com", "domains.txt"},
+		{"a.b.bad.example.com", "domains.txt"},
+		{"notbad.example.com", ""},
+		{"localhost", ""},
+		{"phish.example.net", "hosts.txt"},
+		{"tracker.example.org", "hosts.txt"},
+		{"xn--bcher-scam-9db.example", "domains.txt"},
+		{"www.evil.example.io", "adguard.txt"},
+		{"ok.evil.example.io", ""},
+		{"ads.example.io", "adguard.txt"},
+		{"example.io", ""},
+	}
+	for _, test := range tests {
+		_, name, blocked := blocklist.Match(test.host)
+		assert.Equal(t, test.list != "", blocked, "Match(%q) blocked", test.host)
+		assert.Equal(t, test.list, name, "Match(%q) blocklist", test.host)
+	}
+
+	// Blocked hosts are refused by Add(), even with Force
+	_, _, err = db.AddWithOptions("https://evil.example.io/", "evil", AddOptions{Force: true})
+	assert.True(t, errors.Is(err, ErrHostBlocked), "Add() of blocked host returns ErrHostBlocked")
+
+	// Audit() reports existing mappings that are now blocked
+	results, err := db.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 2, len(results), "Audit() result count") {
+		assert.Equal(t, "bad", results[0].Code)
+		assert.Equal(t, "ph", results[1].Code)
+		assert.True(t, errors.Is(results[1].Err, ErrHostBlocked))
+	}
+}
+
+// TestDuplicates checks duplicate url detection and deduping
+func TestDuplicates(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	// Adding an already-mapped url without a code returns the existing code
+	_, err := db.Add("https://example.com/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := db.Add("HTTPS://Example.com:443/a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a", code, "Add() of existing url returns existing code")
+	code, existing, err := db.AddWithOptions("https://example.com/a", "", AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a", code, "AddWithOptions() of existing url returns existing code")
+	assert.True(t, existing, "AddWithOptions() of existing url reports reuse")
+	err = db.Batch(func(tx *Tx) error {
+		code, existing, err = tx.Add("https://example.com/a", "", AddOptions{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a", code, "Tx.Add() of existing url returns existing code")
+	assert.True(t, existing, "Tx.Add() of existing url reports reuse")
+	code, existing, err = db.AddWithOptions("https://example.com/a", "", AddOptions{New: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, "a", code, "AddWithOptions() with New returns new code")
+	assert.False(t, existing, "AddWithOptions() with New adds a mapping")
+	random := code
+
+	// Explicit codes can still create duplicates
+	for code, url := range map[string]string{
+		"alpha": "https://EXAMPLE.com/a",
+		"b":     "https://example.com",
+		"bee":   "https://example.com/",
+		"c":     "https://example.com/c",
+	} {
+		_, err = db.Add(url, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dups, err := db.Duplicates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, [][]string{{"a", "alpha", random}, {"b", "bee"}}, dups, "Duplicates()")
+
+	// Removing leaves only canonical codes
+	dups, err = db.Dedupe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, [][]string{{"a", "alpha", random}, {"b", "bee"}}, dups, "Dedupe()")
+	testList(t, db, []string{"a", "b", "c"})
+	dups, err = db.Dedupe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(dups), "repeat Dedupe()")
+
+	// Mappings with different visibility are not duplicates, so public
+	// urls are never removed in favour of private codes
+	_, _, err = db.AddWithOptions("https://example.com/d", "ab", AddOptions{Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/d", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dups, err = db.Dedupe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(dups), "Dedupe() with mixed visibility")
+	testList(t, db, []string{"a", "ab", "abc", "b", "c"})
+}
+
+// TestFindByURL checks reverse lookups by url and host
+func TestFindByURL(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	for code, url := range map[string]string{
+		"a":    "https://example.com/docs/a",
+		"b":    "https://example.com/docs/b",
+		"c":    "https://www.example.com/c",
+		"home": "https://Example.com",
+		"x":    "https://other.org/docs/a",
+		"y":    "https://example.com.evil.net/x",
+		"z":    "https://example.community/x",
+	} {
+		_, err := db.Add(url, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		mode  FindMode
+		codes []string
+	}{
+		{"https://example.com/docs/a", FindExact, []string{"a"}},
+		{"https://EXAMPLE.com:443/", FindExact, []string{"home"}},
+		{"https://example.com/docs", FindExact, []string{}},
+		{"https://example.com/docs", FindPrefix, []string{"a", "b"}},
+		{"https://example.com", FindPrefix, []string{"a", "b", "home"}},
+		{"https://www.example.com/", FindPrefix, []string{"c"}},
+		{"https://example.com?x=1", FindPrefix, []string{}},
+		{"https://example.co", FindPrefix, []string{}},
+		{"example.com", FindHost, []string{"a", "b", "home"}},
+		{".example.com", FindHost, []string{"a", "b", "c", "home"}},
+		{"nope.org", FindHost, []string{}},
+	}
+	for _, test := range tests {
+		entries, err := db.FindByURL(test.query, test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := []string{}
+		for _, e := range entries {
+			codes = append(codes, e.Code)
+		}
+		assert.Equal(t, test.codes, codes, "FindByURL(%q, %d)", test.query, test.mode)
+	}
+
+	// The index is cached, without entries, and refreshed after database
+	// changes
+	data, err := ioutil.ReadFile(db.indexPath())
+	assert.Nil(t, err, "index file exists")
+	assert.NotContains(t, string(data), `"entries"`, "index has no entries")
+	err = db.Update("https://other.org/", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.FindByURL("other.org", FindHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(entries), "FindByURL() after Update()")
+
+	// Visibility filters apply as for ListWithOptions
+	private := true
+	err = db.Set("b", SetOptions{Private: &private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for visibility, want := range map[Visibility][]string{
+		ListAll:     {"b", "home"},
+		ListPublic:  {"home"},
+		ListPrivate: {"b"},
+	} {
+		entries, err = db.FindByURLWithOptions("example.com", FindHost, ListOptions{Visibility: visibility})
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes := []string{}
+		for _, e := range entries {
+			codes = append(codes, e.Code)
+		}
+		assert.Equal(t, want, codes, "FindByURLWithOptions() visibility %v", visibility)
+	}
+}
+
+// TestRewrite checks bulk regexp and host rewrites
+func TestRewrite(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	for code, url := range map[string]string{
+		"a": "https://docs.old.com/a",
+		"b": "https://DOCS.old.com:8443/b?x=1",
+		"c": "https://www.docs.old.com/c",
+		"d": "https://example.com/docs.old.com",
+	} {
+		_, err := db.Add(url, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dry runs report changes without making them
+	rewrites, err := db.RewriteHost("docs.old.com", "docs.new.com", RewriteOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Rewrite{
+		{"a", "https://docs.old.com/a", "https://docs.new.com/a"},
+		{"b", "https://DOCS.old.com:8443/b?x=1", "https://docs.new.com:8443/b?x=1"},
+	}, rewrites, "RewriteHost() dry run")
+	mappings := testReadUrls(t, db)
+	assert.Equal(t, "https://docs.old.com/a", mappings["a"], "dry run leaves mappings unchanged")
+
+	rewrites, err = db.RewriteRegexp(regexp.MustCompile(`^https://(www\.)?docs\.old\.com/`),
+		"https://docs.new.com/", RewriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(rewrites), "RewriteRegexp() changes")
+	mappings = testReadUrls(t, db)
+	assert.Equal(t, "https://docs.new.com/c", mappings["c"])
+	assert.Equal(t, "https://example.com/docs.old.com", mappings["d"])
+
+	// Rewrites producing invalid urls fail without changing anything
+	_, err = db.RewriteRegexp(regexp.MustCompile(`^https:`), "htps:", RewriteOptions{})
+	assert.True(t, errors.Is(err, ErrUrlBad), "RewriteRegexp() to invalid url returns ErrUrlBad")
+}
+
+// TestBatch checks batched mutations and rollback
+func TestBatch(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	_, err := db.Add("https://example.com/old", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"add https://example.com/a a",
+		"# comment",
+		"",
+		`{"op":"add","url":"https://example.com/b","code":"b"}`,
+		"update https://example.com/new old",
+		"rm a",
+		"add https://example.com/c",
+	}
+	var ops []*BatchOp
+	for _, line := range lines {
+		op, err := ParseBatchOp(line)
+		if err != nil {
+			t.Fatalf("ParseBatchOp(%q) returned error: %s", line, err)
+		}
+		if op != nil {
+			ops = append(ops, op)
+		}
+	}
+	assert.Equal(t, 5, len(ops), "ParseBatchOp() op count")
+	for _, line := range []string{"add", "update https://example.com/", "rm", "mv a b", `{"op":"rm"}`, "{bad"} {
+		_, err = ParseBatchOp(line)
+		assert.NotNil(t, err, "ParseBatchOp(%q) returns error", line)
+	}
+
+	// A failing op rolls back the whole batch
+	err = db.Batch(func(tx *Tx) error {
+		for _, op := range ops {
+			_, err := tx.Apply(op)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Apply(&BatchOp{Op: "rm", Code: "missing"})
+		return err
+	})
+	assert.Equal(t, ErrNotFound, err, "Batch() returns op error")
+	testList(t, db, []string{"old"})
+
+	// Successful batches are applied in a single write
+	var random string
+	err = db.Batch(func(tx *Tx) error {
+		for _, op := range ops {
+			code, err := tx.Apply(op)
+			if err != nil {
+				return err
+			}
+			random = code
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testList(t, db, []string{"b", "old", random})
+	mappings := testReadUrls(t, db)
+	assert.Equal(t, "https://example.com/new", mappings["old"])
+
+	// The url policy is only read by ops that need it
+	err = db.writeConfigString("{bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/d", "d")
+	assert.NotNil(t, err, "Add() with broken config returns error")
+	err = db.Remove("b")
+	assert.Nil(t, err, "Remove() with broken config")
+	testList(t, db, []string{"old", random})
+}
+
+// TestImport checks importing from csv, tsv, json and yaml files
+func TestImport(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	for file, format := range map[string]string{
+		"links.csv":  FormatCSV,
+		"links.tsv":  FormatTSV,
+		"links.json": FormatJSON,
+		"links.yml":  FormatYAML,
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(testDir, "import", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, format, DetectImportFormat(file, data), "DetectImportFormat(%q)", file)
+		assert.Equal(t, format, DetectImportFormat("", data), "DetectImportFormat(%q) by content", file)
+	}
+
+	// Column mapping with a header row, generated codes, and invalid rows
+	columns := map[string]string{"code": "short", "url": "long url", "title": "name", "tags": "labels"}
+	summary, err := db.ImportFile(filepath.Join(testDir, "import", "links.csv"),
+		ImportOptions{Columns: columns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, summary.Added, "csv import added")
+	if assert.Equal(t, 1, len(summary.Invalid), "csv import invalid") {
+		assert.Equal(t, 5, summary.Invalid[0].Row)
+	}
+	entries, err := db.FindByURL("https://golang.org/", FindExact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(entries), "csv import generated code for row without one")
+	dbEntries, err := db.readDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Entry{Code: "gh", Url: "https://github.com/gavincarr/usher",
+		Title: "Usher on GitHub", Tags: []string{"code", "go"}, Created: testNow}, *dbEntries["gh"])
+
+	// Headerless tsv, with inverted url/code columns
+	summary, err = db.ImportFile(filepath.Join(testDir, "import", "links.tsv"), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, summary.Added, "tsv import added")
+	mappings := testReadUrls(t, db)
+	assert.Equal(t, "https://example.com/tsv2", mappings["tsv2"])
+
+	// Conflicts fail by default, without making any changes
+	path := filepath.Join(testDir, "import", "links.json")
+	_, err = db.ImportFile(path, ImportOptions{})
+	assert.True(t, errors.Is(err, ErrCodeExists), "json import conflict returns ErrCodeExists")
+	_, exists := testReadUrls(t, db)["j1"]
+	assert.False(t, exists, "failed import makes no changes")
+
+	// Dry runs report without changes
+	summary, err = db.ImportFile(path, ImportOptions{OnConflict: ConflictRename, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, summary.Added, "dry run added")
+	assert.Equal(t, 1, summary.Renamed, "dry run renamed")
+	_, exists = testReadUrls(t, db)["j1"]
+	assert.False(t, exists, "dry run makes no changes")
+
+	summary, err = db.ImportFile(path, ImportOptions{OnConflict: ConflictRename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []ImportRename{{Original: "docs", New: "docs-2"}}, summary.Renames)
+	summary, err = db.ImportFile(path, ImportOptions{OnConflict: ConflictSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, summary.Skipped, "skip import skipped")
+	assert.Equal(t, 1, summary.Unchanged, "skip import unchanged")
+	_, err = db.ImportFile(path, ImportOptions{OnConflict: ConflictOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappings = testReadUrls(t, db)
+	assert.Equal(t, "https://example.com/other-docs", mappings["docs"])
+	assert.Equal(t, "https://example.com/other-docs", mappings["docs-2"])
+
+	// YAML in usher database format
+	summary, err = db.ImportFile(filepath.Join(testDir, "import", "links.yml"), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, summary.Added, "yaml import added")
+	entries, err = db.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 9, len(entries), "entries after imports")
+
+	// Repeated codes in one import are each renamed
+	summary, err = db.Import([]ImportRecord{
+		{Row: 1, Entry: Entry{Code: "docs", Url: "https://example.com/docs-a"}},
+		{Row: 2, Entry: Entry{Code: "docs", Url: "https://example.com/docs-b"}},
+	}, ImportOptions{OnConflict: ConflictRename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []ImportRename{
+		{Original: "docs", New: "docs-3"},
+		{Original: "docs", New: "docs-4"},
+	}, summary.Renames, "repeated code renames")
+}
+
+// TestImportAdapters checks importing the export formats of other url shorteners
+func TestImportAdapters(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	tests := []struct {
+		file   string
+		format string
+		count  int
+		code   string
+		entry  Entry
+	}{
+		{"yourls.sql", FormatYOURLS, 3, "ozh", Entry{Code: "ozh", Url: "http://ozh.org/",
+			Title: "Ozh's blog", Created: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Clicks: 12}},
+		{"shlink.json", FormatShlink, 2, "shl1", Entry{Code: "shl1", Url: "https://shlink.io/",
+			Title: "Shlink", Tags: []string{"php", "shortener"},
+			Created: time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC), Clicks: 42}},
+		{"bitly.csv", FormatBitly, 2, "bitdocs", Entry{Code: "bitdocs", Url: "https://dev.bitly.com/",
+			Title: "Docs", Tags: []string{"api", "docs"},
+			Created: time.Date(2019, 8, 10, 10, 11, 12, 0, time.UTC), Clicks: 2}},
+		{"kutt.json", FormatKutt, 2, "kutt", Entry{Code: "kutt", Url: "https://kutt.it/",
+			Title: "Kutt it", Created: time.Date(2022, 1, 2, 3, 4, 5, 678000000, time.UTC), Clicks: 9}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(testDir, "import", test.file)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.format, DetectImportFormat(path, data), "DetectImportFormat(%q)", test.file)
+
+		summary, err := db.ImportFile(path, ImportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.count, summary.Added, "%s import added", test.file)
+
+		dbEntries, err := db.readDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.NotNil(t, dbEntries[test.code], "%s import code %q", test.file, test.code) {
+			entry := *dbEntries[test.code]
+			assert.True(t, test.entry.Created.Equal(entry.Created), "%s created %v", test.file, entry.Created)
+			entry.Created = test.entry.Created
+			assert.Equal(t, test.entry, entry, test.file)
+		}
+	}
+
+	// SQL escapes, NULLs, and quoted commas in yourls dumps
+	mappings := testReadUrls(t, db)
+	assert.Equal(t, "https://example.com/a,b", mappings["notitle"])
+	dbEntries, err := db.readDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "YOURLS, it's yours", dbEntries["yourls"].Title)
+
+	// Bitly codes fall back to the bitlink path
+	assert.Equal(t, "https://bitly.com/", mappings["3abcXYZ"])
+}
+
+// TestDetectImportFormat checks import format detection by file extension and content
+func TestDetectImportFormat(t *testing.T) {
+	tests := []struct {
+		path   string
+		data   string
+		format string
+	}{
+		// Extensions take precedence over content
+		{"links.json", `[{"code":"a","url":"https://example.com/","title":"address and target"}]`, FormatJSON},
+		{"links.csv", "code,url,title\na,https://example.com/,bitlink shortcode longurl\n", FormatCSV},
+		{"links.csv", "code,url,title\na,https://example.com/,INSERT INTO yourls_url VALUES\n", FormatCSV},
+		{"links.yml", `a: "https://example.com/?shortUrls"`, FormatYAML},
+		{"links.json", `{"shortUrls":{"data":[]}}`, FormatShlink},
+		{"links.csv", "Bitlink,Long URL\nbit.ly/a,https://example.com/\n", FormatBitly},
+		// Shortener exports only match their schema
+		{"", `{"data":[{"code":"a","url":"https://example.com/","address":"x"}],"target":"y"}`, FormatJSON},
+		{"", `{"links":[{"address":"a","target":"https://example.com/"}]}`, FormatJSON},
+		{"", `{"data":[{"address":"a","target":"https://example.com/"}]}`, FormatKutt},
+		{"", "code\tnotes\na\tbitlink\n", FormatTSV},
+		{"", "Short Code,Long URL\na,https://example.com/\n", FormatCSV},
+		{"", "shortCode,longUrl\na,https://example.com/\n", FormatShlink},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.format, DetectImportFormat(test.path, []byte(test.data)),
+			"DetectImportFormat(%q, %q)", test.path, test.data)
+	}
+}
+
+// TestBookmarks checks importing and round-tripping Netscape bookmark files
+func TestBookmarks(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	path := filepath.Join(testDir, "import", "bookmarks.html")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, FormatBookmarks, DetectImportFormat("", data), "DetectImportFormat by content")
+
+	records, err := ParseImport(data, FormatBookmarks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 4, len(records), "bookmark records") {
+		assert.Equal(t, Entry{Url: "https://go.dev/", Title: "Go & friends",
+			Created: time.Unix(1600000100, 0).UTC()}, records[0].Entry)
+		assert.Equal(t, Entry{Url: "https://github.com/", Title: "GitHub",
+			Tags: []string{"code", "dev-tools"}, Created: time.Unix(1600000200, 0).UTC()}, records[1].Entry)
+		assert.Equal(t, Entry{Code: "pkg", Url: "https://pkg.go.dev/", Title: "pkg.go.dev",
+			Tags: []string{"dev-tools", "docs"}}, records[2].Entry)
+		assert.Equal(t, Entry{Url: "https://example.com/"}, records[3].Entry)
+	}
+
+	// Export round trip
+	db = doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	err = db.Batch(func(tx *Tx) error {
+		tx.put(Entry{Code: "gh", Url: "https://github.com/", Title: "GitHub",
+			Tags: []string{"code", "dev"}, Created: time.Unix(1600000200, 0).UTC()})
+		tx.put(Entry{Code: "go", Url: "https://go.dev/", Title: "Go <&> friends", Tags: []string{"dev"}})
+		tx.put(Entry{Code: "ex", Url: "https://example.com/"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = db.Export(&buf, ExportOptions{Format: FormatBookmarks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := ioutil.ReadFile(filepath.Join(testGolden, "bookmarks.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(golden), buf.String(), "bookmarks export")
+
+	data = buf.Bytes()
+	records, err = ParseImport(data, FormatBookmarks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(records), "exported bookmarks reimport")
+}
+
+// TestExport checks exporting the database in each export format
+func TestExport(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	err := db.Batch(func(tx *Tx) error {
+		tx.put(Entry{Code: "gh", Url: "https://github.com/", Title: "GitHub",
+			Tags: []string{"code", "dev"}, Created: time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)})
+		tx.put(Entry{Code: "go", Url: "https://go.dev/?q=a|b", Title: "Go <&> *friends*",
+			Tags: []string{"dev"}, Created: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)})
+		tx.put(Entry{Code: "ex", Url: "https://example.com/", Created: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)})
+		tx.put(Entry{Code: "secret", Url: "https://internal.example.com/", Title: "Internal",
+			Created: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), Private: true})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, goldenfile := range map[string]string{
+		FormatHTML:     "export.html",
+		FormatMarkdown: "export.md",
+		FormatAtom:     "export.atom",
+		FormatOPML:     "export.opml",
+	} {
+		var buf bytes.Buffer
+		err = db.Export(&buf, ExportOptions{Format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden, err := ioutil.ReadFile(filepath.Join(testGolden, goldenfile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(golden), buf.String(), "%s export", format)
+		assert.NotContains(t, buf.String(), "secret", "%s export excludes private entries", format)
+	}
+
+	err = db.Export(ioutil.Discard, ExportOptions{Format: "bogus"})
+	assert.Error(t, err, "invalid export format")
+}
+
+// TestPrivate checks adding, listing, and setting private entries
+func TestPrivate(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	_, _, err := db.AddWithOptions("https://example.com/public", "pub", AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.AddWithOptions("https://example.com/private", "priv", AddOptions{Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.AddWithOptions("https://example.com/", indexCode, AddOptions{Private: true})
+	assert.Equal(t, ErrIndexPrivate, err, "INDEX cannot be added private")
+
+	// Adding a url without a code only reuses codes with the same visibility
+	code, _, err := db.AddWithOptions("https://example.com/public", "", AddOptions{Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, "pub", code, "private add does not reuse public code")
+	code2, existing, err := db.AddWithOptions("https://example.com/public", "", AddOptions{Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, existing, "private add reports reuse")
+	assert.Equal(t, code, code2, "private add reuses private code")
+	code2, _, err = db.AddWithOptions("https://example.com/private", "", AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, "priv", code2, "public add does not reuse private code")
+	err = db.Remove(code2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Remove(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for visibility, want := range map[Visibility][]string{
+		ListAll:     {"priv", "pub"},
+		ListPublic:  {"pub"},
+		ListPrivate: {"priv"},
+	} {
+		entries, err := db.ListWithOptions(ListOptions{Visibility: visibility})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codes []string
+		for _, e := range entries {
+			codes = append(codes, e.Code)
+		}
+		assert.Equal(t, want, codes, "ListWithOptions visibility %d", visibility)
+	}
+
+	// Set
+	title := "Public page"
+	public, private := false, true
+	err = db.Set("pub", SetOptions{Title: &title, Tags: []string{"a"}, Private: &private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Set("priv", SetOptions{Private: &public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.ListWithOptions(ListOptions{Visibility: ListPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Entry{{Code: "pub", Url: "https://example.com/public",
+		Title: "Public page", Tags: []string{"a"}, Created: testNow, Private: true}}, entries)
+	err = db.Set("pub", SetOptions{Tags: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = db.ListWithOptions(ListOptions{Visibility: ListPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, entries[0].Tags, "Set with empty tags clears them")
+	assert.Equal(t, ErrNotFound, db.Set("missing", SetOptions{Private: &private}))
+
+	_, err = db.Add("https://example.com/", indexCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrIndexPrivate, db.Set(indexCode, SetOptions{Private: &private}),
+		"INDEX cannot be set private")
+
+	var buf bytes.Buffer
+	err = db.Export(&buf, ExportOptions{Format: FormatMarkdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, buf.String(), "example.com/public", "export excludes private entries")
+	assert.Contains(t, buf.String(), "example.com/private", "export includes public entries")
+}
+
+// testBackend is a Backend that records pushed mappings in memory
+type testBackend struct {
+	options struct {
+		Fail bool `yaml:"fail"`
+	}
+	pushed map[string]string
+}
+
+func (b *testBackend) Validate() error {
+	if b.options.Fail {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+func (b *testBackend) Plan(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	return diffMappings(b.pushed, mappings, !opts.NoPrune), nil
+}
+
+func (b *testBackend) Push(mappings map[string]string, opts PushOptions) (*Plan, error) {
+	plan := diffMappings(b.pushed, mappings, !opts.NoPrune)
+	b.pushed = mappings
+	return plan, nil
+}
+
+func (b *testBackend) Pull() (map[string]string, error) {
+	return b.pushed, nil
+}
+
+// TestBackends checks backend registration, option decoding, and the render backend
+func TestBackends(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	backend := &testBackend{pushed: map[string]string{"old": "https://example.com/old"}}
+	RegisterBackend("test", func(db *DB, config *ConfigEntry) (Backend, error) {
+		backend.options.Fail = false
+		err := config.DecodeOptions(&backend.options)
+		return backend, err
+	})
+	assert.Contains(t, Backends(), "test")
+	assert.Contains(t, Backends(), "s3")
+	assert.Contains(t, Backends(), "render")
+	assert.Panics(t, func() { RegisterBackend("test", nil) }, "duplicate registration panics")
+
+	_, err := db.Add("https://example.com/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown options and validation failures are errors
+	err = db.writeConfigString(domain + ":\n  type: test\n  bogus: 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, db.Push(), "unknown backend option")
+	err = db.writeConfigString(domain + ":\n  type: test\n  fail: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, db.Push(), "backend validation failure")
+
+	err = db.writeConfigString(domain + ":\n  type: test\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Change{
+		{Code: "a", Action: ActionCreate, Url: "https://example.com/a"},
+		{Code: "old", Action: ActionDelete, OldUrl: "https://example.com/old"},
+	}, plan.Changes)
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"a": "https://example.com/a"}, pulled)
+
+	// Render plans and pulls from render.yaml
+	_, err = db.Add("https://example.com/", indexCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/café", "café")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeConfigString(domain + ":\n  type: render\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, plan.Count(ActionCreate), "render plan before push")
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled, err = db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testReadUrls(t, db), pulled, "render pull after push")
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, plan.Count(ActionUnchanged), "render plan after push")
+}
+
+// TestExecBackend checks pushes and pulls via external `usher-backend-TYPE` executables
+func TestExecBackend(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	// Build the reference backend from testdata
+	binDir := filepath.Join(db.Root, "bin")
+	command := filepath.Join(binDir, "usher-backend-file")
+	out, err := exec.Command("go", "build", "-o", command, "./testdata/exec-backend").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building exec backend: %s\n%s", err, out)
+	}
+
+	_, err = db.Add("https://example.com/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/b", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing options fail validation
+	err = db.writeConfigString(domain + ":\n  type: exec\n  command: " + command + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if assert.Error(t, err, "exec backend validation") {
+		assert.Contains(t, err.Error(), "'path' option is required")
+	}
+
+	outfile := filepath.Join(db.Root, "published.json")
+	err = db.writeConfigString(domain + ":\n  type: exec\n  command: " + command +
+		"\n  path: " + outfile + "\n  fail: [ b ]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, plan.Count(ActionCreate), "exec plan via pull")
+
+	// Per-code failures are reported as PushErrors
+	err = db.Push()
+	var pushErrs PushErrors
+	if assert.True(t, errors.As(err, &pushErrs), "exec push returns PushErrors") {
+		assert.Equal(t, 1, len(pushErrs))
+		assert.Equal(t, "b", pushErrs[0].Code)
+	}
+	pulled, err := db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"a": "https://example.com/a"}, pulled)
+
+	// Backends can also be found on the PATH as `usher-backend-TYPE`
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	err = db.writeConfigString(domain + ":\n  type: file\n  path: " + outfile + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled, err = db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testReadUrls(t, db), pulled, "exec pull after push")
+
+	// Unknown types without an executable are still bad
+	err = db.writeConfigString(domain + ":\n  type: nonesuch\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, errors.Is(db.Push(), ErrPushTypeBad), "unknown backend type")
+}
+
+// fakeS3Object is an object stored by fakeS3
+type fakeS3Object struct {
+	redirect    string
+	metadata    map[string]string
+	headers     map[string]string // other object settings, by header
+	contentType string
+	body        string
+}
+
+// fakeS3Headers are the object setting headers recorded by fakeS3
+var fakeS3Headers = []string{"Cache-Control", "X-Amz-Acl", "X-Amz-Storage-Class",
+	"X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"}
+
+// fakeS3 is a minimal in-process S3 server, supporting the path-style
+// object operations used by the s3 backend
+type fakeS3 struct {
+	mu          sync.Mutex
+	buckets     map[string]map[string]*fakeS3Object
+	settings    map[string]map[string]string // bucket subresource documents
+	pageSize    int
+	requests    map[string]int  // request counts by operation
+	fail        map[string]bool // keys to refuse uploads for
+	flaky       map[string]int  // keys to throttle uploads for, n times
+	delay       time.Duration   // delay before handling each request
+	allow       map[string]bool // IAM actions allowed, if set
+	inflight    int
+	maxInflight int
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	f := &fakeS3{
+		buckets:  make(map[string]map[string]*fakeS3Object),
+		settings: make(map[string]map[string]string),
+		pageSize: 2,
+		requests: make(map[string]int),
+		fail:     make(map[string]bool),
+		flaky:    make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = make(map[string]*fakeS3Object)
+		f.settings[bucket] = make(map[string]string)
+	}
+	return f
+}
+
+// fakeS3Subresources are the bucket subresources supported by fakeS3,
+// with the error codes returned when they're not set
+var fakeS3Subresources = map[string]string{
+	"website":           "NoSuchWebsiteConfiguration",
+	"policy":            "NoSuchBucketPolicy",
+	"publicAccessBlock": "NoSuchPublicAccessBlockConfiguration",
+	"ownershipControls": "OwnershipControlsNotFoundError",
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.inflight++
+	if f.inflight > f.maxInflight {
+		f.maxInflight = f.inflight
+	}
+	delay := f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight--
+
+	if r.Method == "GET" && r.URL.Path == "/federation/credentials" {
+		// AWS SSO GetRoleCredentials (the SDK uses s3_endpoint for all
+		// services), for SSO profiles
+		f.requests["sso"]++
+		if r.Header.Get("X-Amz-Sso_bearer_token") != "ssotoken" || r.URL.Query().Get("role_name") != "usher" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"Session token not found or invalid"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"roleCredentials":{"accessKeyId":"AKIDSSO","secretAccessKey":"secret","sessionToken":"token","expiration":%d}}`,
+			time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond))
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if r.Method == "PUT" && len(parts) == 1 && r.URL.RawQuery == "" {
+		f.requests["createbucket"]++
+		if _, exists := f.buckets[parts[0]]; exists {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `<Error><Code>BucketAlreadyOwnedByYou</Code></Error>`)
+			return
+		}
+		f.buckets[parts[0]] = make(map[string]*fakeS3Object)
+		f.settings[parts[0]] = make(map[string]string)
+		return
+	}
+	objects, exists := f.buckets[parts[0]]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code></Error>`)
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	subresource := ""
+	for name := range fakeS3Subresources {
+		if r.URL.Query()[name] != nil {
+			subresource = name
+		}
+	}
+
+	switch {
+	case key == "" && subresource != "":
+		f.requests[r.Method+" "+subresource]++
+		settings := f.settings[parts[0]]
+		switch r.Method {
+		case "GET":
+			doc, exists := settings[subresource]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, `<Error><Code>%s</Code></Error>`, fakeS3Subresources[subresource])
+				return
+			}
+			fmt.Fprint(w, doc)
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			settings[subresource] = string(body)
+		case "DELETE":
+			delete(settings, subresource)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case r.Method == "GET" && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.requests["list"]++
+		if !f.allowed(w, "s3:ListBucket") {
+			return
+		}
+		var keys []string
+		for k := range objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		start := sort.SearchStrings(keys, r.URL.Query().Get("continuation-token"))
+		end := start + f.pageSize
+		truncated := end < len(keys)
+		if !truncated {
+			end = len(keys)
+		}
+		var b strings.Builder
+		b.WriteString(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		for _, k := range keys[start:end] {
+			b.WriteString("<Contents><Key>")
+			xml.EscapeText(&b, []byte(k))
+			b.WriteString("</Key></Contents>")
+		}
+		fmt.Fprintf(&b, "<KeyCount>%d</KeyCount><IsTruncated>%t</IsTruncated>", end-start, truncated)
+		if truncated {
+			b.WriteString("<NextContinuationToken>")
+			xml.EscapeText(&b, []byte(keys[end]))
+			b.WriteString("</NextContinuationToken>")
+		}
+		b.WriteString("</ListBucketResult>")
+		fmt.Fprint(w, b.String())
+
+	case r.Method == "HEAD" && key == "":
+		f.requests["headbucket"]++
+
+	case r.Method == "HEAD" && key != "":
+		f.requests["head"]++
+		if !f.allowed(w, "s3:GetObject") {
+			return
+		}
+		obj, exists := objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if obj.redirect != "" {
+			w.Header().Set("X-Amz-Website-Redirect-Location", obj.redirect)
+		}
+		for k, v := range obj.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+
+	case r.Method == "PUT" && key != "":
+		f.requests["put"]++
+		body, _ := ioutil.ReadAll(r.Body)
+		actions := []string{"s3:PutObject"}
+		if r.Header.Get("X-Amz-Acl") != "" {
+			actions = append(actions, "s3:PutObjectAcl")
+		}
+		if !f.allowed(w, actions...) {
+			return
+		}
+		if f.flaky[key] > 0 {
+			f.flaky[key]--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+			return
+		}
+		if f.fail[key] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		obj := &fakeS3Object{
+			redirect:    r.Header.Get("X-Amz-Website-Redirect-Location"),
+			metadata:    make(map[string]string),
+			headers:     make(map[string]string),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(body),
+		}
+		for _, header := range fakeS3Headers {
+			if value := r.Header.Get(header); value != "" {
+				obj.headers[header] = value
+			}
+		}
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				obj.metadata[strings.TrimPrefix(k, "X-Amz-Meta-")] = r.Header.Get(k)
+			}
+		}
+		objects[key] = obj
+		w.Header().Set("ETag", `"fake"`)
+
+	case r.Method == "POST" && key == "" && r.URL.Query()["delete"] != nil:
+		f.requests["delete"]++
+		if !f.allowed(w, "s3:DeleteObject") {
+			return
+		}
+		var req struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		err := xml.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, o := range req.Objects {
+			delete(objects, o.Key)
+		}
+		fmt.Fprint(w, `<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></DeleteResult>`)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// allowed reports whether actions are all allowed by the IAM actions
+// in f.allow (if set), writing an AccessDenied error if not
+func (f *fakeS3) allowed(w http.ResponseWriter, actions ...string) bool {
+	if f.allow == nil {
+		return true
+	}
+	for _, action := range actions {
+		if !f.allow[action] {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return false
+		}
+	}
+	return true
+}
+
+// put stores a redirect object directly in bucket
+func (f *fakeS3) put(bucket, key, redirect string, managed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := &fakeS3Object{redirect: redirect, metadata: make(map[string]string)}
+	if managed {
+		obj.metadata[s3ManagedKey] = "1"
+	}
+	f.buckets[bucket][key] = obj
+}
+
+// keys returns the sorted keys in bucket
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// doSetupS3 sets up db to push to a fakeS3 server, returning the
+// fake and a cleanup function
+func doSetupS3(t *testing.T, db *DB, options string) (*fakeS3, func()) {
+	fake := newFakeS3(db.Domain)
+	server := httptest.NewServer(fake)
+	err := db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" +
+		"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n" + options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server.Close
+}
+
+// TestS3Prune checks that s3 pushes delete removed codes, subject to prune_limit
+func TestS3Prune(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "  prune_limit: 2\n")
+	defer cleanup()
+
+	for code, url := range map[string]string{
+		"a": "https://example.com/a",
+		"b": "https://example.com/b",
+		"c": "https://example.com/c",
+		"d": "https://example.com/d",
+		"é": "https://example.com/e",
+	} {
+		_, err := db.Add(url, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unmanaged objects are never pruned
+	fake.put(db.Domain, "index.html", "", false)
+	fake.put(db.Domain, "manual", "https://example.com/manual", false)
+
+	err := db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "index.html", "manual", "é"}, fake.keys(db.Domain))
+
+	// Removed codes are pruned, unless NoPrune
+	for _, code := range []string{"a", "b", "c"} {
+		err = db.Remove(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := db.PlanWithOptions(PushOptions{NoPrune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, plan.Count(ActionDelete), "no-prune plan deletes")
+	_, err = db.PushWithOptions(PushOptions{NoPrune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 7, len(fake.keys(db.Domain)), "no-prune push")
+
+	// Deletions beyond prune_limit require Force
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, plan.Count(ActionDelete), "prune plan deletes")
+	err = db.Push()
+	assert.Error(t, err, "push over prune limit")
+	assert.Equal(t, 7, len(fake.keys(db.Domain)), "push over prune limit makes no deletions")
+	_, err = db.PushWithOptions(PushOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"d", "index.html", "manual", "é"}, fake.keys(db.Domain))
+
+	pulled, err := db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"d":      "https://example.com/d",
+		"manual": "https://example.com/manual",
+		"é":      "https://example.com/e",
+	}, pulled)
+}
+
+// TestS3Incremental checks that s3 pushes only upload new and changed codes
+func TestS3Incremental(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "")
+	defer cleanup()
+
+	for _, code := range []string{"a", "b", "c"} {
+		_, err := db.Add("https://example.com/"+code, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := db.PushWithOptions(PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, plan.Count(ActionCreate), "initial push creates")
+	assert.Equal(t, 3, fake.requests["put"], "initial push puts")
+
+	// Unchanged codes are not uploaded again
+	plan, err = db.PushWithOptions(PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, plan.Count(ActionUnchanged), "repeat push unchanged")
+	assert.Equal(t, 3, fake.requests["put"], "repeat push makes no puts")
+
+	// Only new and changed codes are uploaded
+	err = db.Update("https://example.com/b2", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/d", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Remove("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = db.PushWithOptions(PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Change{
+		{Code: "a", Action: ActionUnchanged, Url: "https://example.com/a"},
+		{Code: "b", Action: ActionUpdate, Url: "https://example.com/b2", OldUrl: "https://example.com/b"},
+		{Code: "c", Action: ActionDelete, OldUrl: "https://example.com/c"},
+		{Code: "d", Action: ActionCreate, Url: "https://example.com/d"},
+	}, plan.Changes)
+	assert.Equal(t, 5, fake.requests["put"], "incremental push puts")
+}
+
+// TestS3Concurrency checks that s3 pushes run requests concurrently, up to s3_concurrency
+func TestS3Concurrency(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "  s3_concurrency: 4\n")
+	defer cleanup()
+	fake.delay = 20 * time.Millisecond
+
+	for i := 0; i < 20; i++ {
+		code := fmt.Sprintf("c%02d", i)
+		_, err := db.Add("https://example.com/"+code, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failures are collected, and don't stop other uploads
+	fake.fail["c03"] = true
+	fake.fail["c11"] = true
+	_, err := db.PushWithOptions(PushOptions{})
+	var errs PushErrors
+	if assert.True(t, errors.As(err, &errs), "push with failures returns PushErrors") {
+		assert.Equal(t, 2, len(errs), "push errors")
+		assert.Equal(t, "c03", errs[0].Code)
+		assert.Equal(t, "c11", errs[1].Code)
+	}
+	assert.Equal(t, 18, len(fake.keys(db.Domain)), "successful uploads")
+	assert.True(t, fake.maxInflight > 1, "requests are concurrent")
+	assert.True(t, fake.maxInflight <= 4, "requests are limited by s3_concurrency")
+
+	// Failed codes are retried on the next push
+	delete(fake.fail, "c03")
+	delete(fake.fail, "c11")
+	plan, err := db.PushWithOptions(PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, plan.Count(ActionCreate), "retry push creates")
+	assert.Equal(t, 20, len(fake.keys(db.Domain)), "all uploads")
+
+	// Cancelled pushes make no changes
+	_, err = db.Add("https://example.com/new", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.PushWithOptions(PushOptions{Context: ctx})
+	assert.True(t, errors.Is(err, context.Canceled), "cancelled push returns context.Canceled")
+	assert.Equal(t, 20, len(fake.keys(db.Domain)), "cancelled push uploads")
+}
+
+// TestS3Retry checks that s3 pushes retry transient errors, up to s3_retries
+func TestS3Retry(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "  s3_retries: 2\n")
+	defer cleanup()
+
+	for _, code := range []string{"a", "b", "c"} {
+		_, err := db.Add("https://example.com/"+code, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Throttled requests are retried, up to s3_retries times
+	fake.flaky["a"] = 2
+	fake.flaky["b"] = 3
+	_, err := db.PushWithOptions(PushOptions{})
+	var errs PushErrors
+	if assert.True(t, errors.As(err, &errs), "push with failures returns PushErrors") {
+		assert.Equal(t, 1, len(errs), "push errors")
+		assert.Equal(t, "b", errs[0].Code)
+	}
+	assert.Equal(t, []string{"a", "c"}, fake.keys(db.Domain))
+	assert.Equal(t, 7, fake.requests["put"], "puts including retries")
+
+	// Failed codes are recorded, and retried by a resumed push, without
+	// re-reading the bucket
+	statePath := filepath.Join(db.Root, "."+db.Domain+".push.json")
+	assert.FileExists(t, statePath)
+	heads := fake.requests["head"]
+	plan, err := db.PushWithOptions(PushOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Change{
+		{Code: "b", Action: ActionCreate, Url: "https://example.com/b"},
+	}, plan.Changes)
+	assert.Equal(t, []string{"a", "b", "c"}, fake.keys(db.Domain))
+	assert.Equal(t, heads, fake.requests["head"], "resume makes no head requests")
+	_, err = os.Stat(statePath)
+	assert.True(t, os.IsNotExist(err), "state file removed after successful push")
+
+	_, err = db.PushWithOptions(PushOptions{Resume: true})
+	assert.Error(t, err, "resume with no interrupted push")
+
+	// Resuming after mappings have changed is an error
+	fake.fail["d"] = true
+	_, err = db.Add("https://example.com/d", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PushWithOptions(PushOptions{})
+	assert.Error(t, err, "push with failure")
+	err = db.Update("https://example.com/d2", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PushWithOptions(PushOptions{Resume: true})
+	assert.Error(t, err, "resume with changed mapping")
+}
+
+// TestS3Endpoint checks s3 pushes to S3-compatible services using s3_endpoint and s3_ca_bundle
+func TestS3Endpoint(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+
+	fake := newFakeS3("links")
+	server := httptest.NewUnstartedServer(fake)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	caBundle := filepath.Join(db.Root, "ca.pem")
+	err := ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Add("https://example.com/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" +
+		"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n  s3_bucket: links\n  s3_retries: 0\n"
+
+	// Without the CA bundle, the server certificate is untrusted
+	err = db.writeConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, db.Push(), "push to endpoint with untrusted certificate")
+	assert.Equal(t, 0, len(fake.keys("links")))
+
+	err = db.writeConfigString(config + "  s3_ca_bundle: " + caBundle + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a"}, fake.keys("links"), "push to s3_bucket")
+
+	// Invalid options are rejected
+	for _, option := range []string{
+		"  s3_ca_bundle: " + filepath.Join(db.Root, "missing.pem") + "\n",
+		"  s3_endpoint: localhost:9000\n",
+	} {
+		err = db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" + option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, db.Push(), "invalid option "+option)
+	}
+}
+
+// TestS3Credentials checks the s3 backend credential sources, as reported by doctor
+func TestS3Credentials(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake := newFakeS3(db.Domain)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Isolate the SDK from any real AWS environment
+	credsFile := filepath.Join(db.Root, "aws_credentials")
+	err := ioutil.WriteFile(credsFile, []byte("[usher]\naws_access_key_id = AKIDPROFILE\naws_secret_access_key = secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_PROFILE":                 "",
+		"AWS_CONFIG_FILE":             filepath.Join(db.Root, "aws_config"),
+		"AWS_SHARED_CREDENTIALS_FILE": credsFile,
+		"AWS_EC2_METADATA_DISABLED":   "true",
+		"HOME":                        db.Root,
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	doctor := func(options string) map[string]Check {
+		err := db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_region: us-east-1\n" +
+			"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n" + options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checks := make(map[string]Check)
+		for _, c := range db.Doctor() {
+			checks[c.Name] = c
+		}
+		return checks
+	}
+
+	checks := doctor("  aws_key: AKIDSTATIC\n  aws_secret: secret\n")
+	assert.Equal(t, "StaticProvider (aws_key)", checks["s3 credentials"].Result, "static credentials")
+	assert.Equal(t, "ok", checks["s3 access"].Result, "bucket access")
+
+	checks = doctor("  aws_profile: usher\n")
+	assert.Equal(t, "SharedConfigCredentials: "+credsFile+` (profile "usher")`, checks["s3 credentials"].Result, "profile credentials")
+	assert.NoError(t, checks["s3 access"].Err, "bucket access")
+
+	checks = doctor("  aws_profile: bogus\n")
+	assert.Error(t, checks["s3 credentials"].Err, "missing profile")
+
+	// SSO profiles use the token cached by `aws sso login`
+	startURL := "https://example.awsapps.com/start"
+	err = ioutil.WriteFile(filepath.Join(db.Root, "aws_config"), []byte("[profile sso]\nsso_start_url = "+startURL+
+		"\nsso_region = us-east-1\nsso_account_id = 123456789012\nsso_role_name = usher\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks = doctor("  aws_profile: sso\n")
+	assert.Error(t, checks["s3 credentials"].Err, "SSO profile without cached token")
+	cacheDir := filepath.Join(db.Root, ".aws", "sso", "cache")
+	err = os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := fmt.Sprintf(`{"accessToken":"ssotoken","expiresAt":%q}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	err = ioutil.WriteFile(filepath.Join(cacheDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(startURL)))), []byte(token), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks = doctor("  aws_profile: sso\n")
+	assert.Equal(t, `SSOProvider (profile "sso")`, checks["s3 credentials"].Result, "SSO credentials")
+	assert.Equal(t, "ok", checks["s3 access"].Result, "bucket access with SSO credentials")
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	checks = doctor("")
+	assert.Equal(t, "EnvConfigCredentials", checks["s3 credentials"].Result, "environment credentials")
+	err = db.Push()
+	assert.NoError(t, err, "push with environment credentials")
+
+	checks = doctor("  s3_bucket: missing\n")
+	assert.Error(t, checks["s3 access"].Err, "missing bucket")
+
+	checks = doctor("  aws_key: AKIDSTATIC\n")
+	assert.Error(t, checks["backend"].Err, "aws_key without aws_secret")
+}
+
+// TestS3Setup checks that s3 setup plans and applies only the bucket changes needed
+func TestS3Setup(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	err := db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" +
+		"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptions := func(setup *Setup) []string {
+		var desc []string
+		for _, change := range setup.Changes {
+			desc = append(desc, change.Description)
+		}
+		return desc
+	}
+
+	// A new bucket needs everything
+	setup, err := db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		`create bucket "example.me" in us-east-1`,
+		`enable website hosting for bucket "example.me", with index document INDEX`,
+		`allow public bucket policies for bucket "example.me" (public access block settings)`,
+		`set bucket policy for bucket "example.me" to allow public reads`,
+	}, descriptions(setup))
+	assert.Equal(t, 0, fake.requests["createbucket"], "planning makes no changes")
+	err = setup.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, fake.settings[db.Domain]["website"], "<Suffix>INDEX</Suffix>")
+	assert.Contains(t, fake.settings[db.Domain]["publicAccessBlock"], "<BlockPublicPolicy>false</BlockPublicPolicy>")
+	assert.Contains(t, fake.settings[db.Domain]["policy"], `"arn:aws:s3:::example.me/*"`)
+
+	// Setup is idempotent
+	setup, err = db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(setup.Changes), "repeat setup changes")
+
+	// Only settings that differ are changed
+	fake.settings[db.Domain]["policy"] = `{"Version": "2012-10-17", "Statement": []}`
+	fake.settings[db.Domain]["publicAccessBlock"] = `<PublicAccessBlockConfiguration><BlockPublicAcls>true</BlockPublicAcls><IgnorePublicAcls>true</IgnorePublicAcls><BlockPublicPolicy>true</BlockPublicPolicy><RestrictPublicBuckets>true</RestrictPublicBuckets></PublicAccessBlockConfiguration>`
+	setup, err = db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		`allow public bucket policies for bucket "example.me" (public access block settings)`,
+		`replace bucket policy for bucket "example.me" to allow public reads`,
+	}, descriptions(setup))
+	err = setup.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With website documents, the website uses index.html and 404.html
+	err = db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" +
+		"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n  s3_documents: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup, err = db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		`enable website hosting for bucket "example.me", with index document index.html and error document 404.html`,
+	}, descriptions(setup), "website documents setup")
+	err = setup.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, fake.settings[db.Domain]["website"], "<Suffix>index.html</Suffix>")
+	assert.Contains(t, fake.settings[db.Domain]["website"], "<Key>404.html</Key>")
+
+	// Public ACLs need public access blocks and object ownership to
+	// allow them
+	err = db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_key: key\n  aws_secret: secret\n  aws_region: us-east-1\n" +
+		"  s3_endpoint: " + server.URL + "\n  s3_path_style: true\n  s3_documents: true\n" +
+		"  s3_overrides:\n    news:\n      acl: public-read\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup, err = db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		`allow public bucket policies and ACLs for bucket "example.me" (public access block settings)`,
+		`enable ACLs for bucket "example.me" (object ownership BucketOwnerPreferred)`,
+	}, descriptions(setup), "public ACL setup")
+	err = setup.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, fake.settings[db.Domain]["publicAccessBlock"], "<BlockPublicAcls>false</BlockPublicAcls>")
+	assert.Contains(t, fake.settings[db.Domain]["publicAccessBlock"], "<IgnorePublicAcls>false</IgnorePublicAcls>")
+	assert.Contains(t, fake.settings[db.Domain]["ownershipControls"], "<ObjectOwnership>BucketOwnerPreferred</ObjectOwnership>")
+	setup, err = db.Setup("s3", SetupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(setup.Changes), "repeat public ACL setup changes")
+
+	// IAM setup requires AWS
+	_, err = db.Setup("s3", SetupOptions{IAMUser: "usher"})
+	assert.Error(t, err, "IAM setup with custom endpoint")
+	_, err = db.Setup("render", SetupOptions{})
+	assert.Error(t, err, "setup for unconfigured backend type")
+}
+
+// object returns a copy of the object with key in bucket
+func (f *fakeS3) object(bucket, key string) fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if obj, exists := f.buckets[bucket][key]; exists {
+		return *obj
+	}
+	return fakeS3Object{}
+}
+
+// TestS3ObjectSettings checks s3 object metadata, settings and per-code overrides
+func TestS3ObjectSettings(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	settings := "  s3_cache_control: max-age=300\n  s3_storage_class: STANDARD_IA\n" +
+		"  s3_sse: aws:kms\n  s3_sse_kms_key_id: alias/usher\n  s3_acl: public-read\n" +
+		"  s3_metadata:\n    Owner: web-team\n" +
+		"  s3_overrides:\n    b:\n      acl: private\n      storage_class: STANDARD\n" +
+		"      metadata:\n        owner: docs-team\n        Team: docs\n"
+	fake, cleanup := doSetupS3(t, db, settings)
+	defer cleanup()
+
+	title := "Café ☕ notes"
+	created := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	err := db.Batch(func(tx *Tx) error {
+		tx.put(Entry{Code: "a", Url: "https://example.com/a", Title: title, Created: created})
+		tx.put(Entry{Code: "b", Url: "https://example.com/b"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := fake.object(db.Domain, "a")
+	assert.Equal(t, map[string]string{
+		"Cache-Control":                "max-age=300",
+		"X-Amz-Acl":                    "public-read",
+		"X-Amz-Storage-Class":          "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption": "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/usher",
+	}, obj.headers)
+	assert.Equal(t, "web-team", obj.metadata["Owner"])
+	assert.Equal(t, Version, obj.metadata[s3VersionKey])
+	decoded, err := new(mime.WordDecoder).DecodeHeader(obj.metadata[s3TitleKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, title, decoded, "title round-trips")
+	assert.Equal(t, created.Format(time.RFC3339), obj.metadata[s3CreatedKey])
+	_, exists := fake.object(db.Domain, "b").metadata[s3TitleKey]
+	assert.False(t, exists, "no title metadata for untitled entries")
+
+	// Overrides replace settings and metadata for their codes
+	obj = fake.object(db.Domain, "b")
+	assert.Equal(t, map[string]string{
+		"Cache-Control":                "max-age=300",
+		"X-Amz-Acl":                    "private",
+		"X-Amz-Storage-Class":          "STANDARD",
+		"X-Amz-Server-Side-Encryption": "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/usher",
+	}, obj.headers, "override headers")
+	assert.Equal(t, "docs-team", obj.metadata["Owner"], "override metadata")
+	assert.Equal(t, "docs", obj.metadata["Team"], "override metadata")
+
+	// Metadata and settings changes update objects, even with unchanged urls
+	plan, err := db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, plan.Count(ActionUnchanged), "repeat push unchanged")
+	title = "Notes"
+	err = db.Set("b", SetOptions{Title: &title})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Change{
+		{Code: "a", Action: ActionUnchanged, Url: "https://example.com/a"},
+		{Code: "b", Action: ActionUpdate, Url: "https://example.com/b", OldUrl: "https://example.com/b"},
+	}, plan.Changes, "title change")
+	config, err := ioutil.ReadFile(db.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeConfigString(strings.Replace(string(config), "max-age=300", "max-age=600", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, plan.Count(ActionUpdate), "cache-control change")
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ioutil.ReadFile(db.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeConfigString(strings.Replace(string(config), "Team: docs", "Team: web", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err = db.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Change{
+		{Code: "a", Action: ActionUnchanged, Url: "https://example.com/a"},
+		{Code: "b", Action: ActionUpdate, Url: "https://example.com/b", OldUrl: "https://example.com/b"},
+	}, plan.Changes, "override change")
+
+	// Invalid settings are rejected
+	for _, option := range []string{
+		"  s3_acl: world-writable\n",
+		"  s3_storage_class: CHEAP\n",
+		"  s3_sse_kms_key_id: alias/usher\n",
+		"  s3_metadata:\n    Usher-Title: x\n",
+		"  s3_metadata:\n    Owner: Zoë\n",
+		"  s3_overrides:\n    a:\n      acl: world-writable\n",
+		"  s3_overrides:\n    a:\n      expires: never\n",
+		"  s3_overrides:\n    a:\n      metadata:\n        Usher-Title: x\n",
+	} {
+		err = db.writeConfigString(db.Domain + ":\n  type: s3\n  aws_region: us-east-1\n" + option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, db.Push(), "invalid option "+option)
+	}
+}
+
+// TestS3WritePolicy checks that the setup IAM policy grants everything s3 pushes need
+func TestS3WritePolicy(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "  s3_acl: public-read\n")
+	defer cleanup()
+
+	// Restrict the fake to the actions granted by the setup IAM policy
+	var policy struct {
+		Statement []struct {
+			Action []string
+		}
+	}
+	err := json.Unmarshal([]byte(fmt.Sprintf(s3WritePolicy, db.Domain)), &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.allow = make(map[string]bool)
+	for _, statement := range policy.Statement {
+		for _, action := range statement.Action {
+			fake.allow[action] = true
+		}
+	}
+
+	_, err = db.Add("https://example.com/a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "public-read", fake.object(db.Domain, "a").headers["X-Amz-Acl"])
+
+	// Pushes with s3_acl are denied without s3:PutObjectAcl
+	delete(fake.allow, "s3:PutObjectAcl")
+	_, err = db.Add("https://example.com/b", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, db.Push(), "push without s3:PutObjectAcl")
+}
+
+// TestS3Documents checks publishing s3 website documents
+func TestS3Documents(t *testing.T) {
+	db := doSetupTemp(t)
+	defer os.RemoveAll(db.Root)
+	fake, cleanup := doSetupS3(t, db, "  s3_documents: true\n")
+	defer cleanup()
+	config, err := ioutil.ReadFile(db.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure := func(options string) {
+		err := db.writeConfigString(string(config) + options)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err = db.AddWithOptions("https://example.com/", indexCode, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.AddWithOptions("https://example.com/a", "a", AddOptions{Title: "Example A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.AddWithOptions("https://internal.example.com/", "secret", AddOptions{Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, index.html redirects to the INDEX url
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"404.html", "INDEX", "a", "index.html", "robots.txt", "secret"}, fake.keys(db.Domain))
+	index := fake.object(db.Domain, "index.html")
+	assert.Equal(t, "https://example.com/", index.redirect, "index redirect")
+	assert.Equal(t, "1", index.metadata[s3DocumentKey])
+	notFound := fake.object(db.Domain, "404.html")
+	assert.Equal(t, "text/html; charset=utf-8", notFound.contentType)
+	assert.Contains(t, notFound.body, "no example.me link here")
+	robots := fake.object(db.Domain, "robots.txt")
+	assert.Equal(t, "text/plain; charset=utf-8", robots.contentType)
+	assert.Equal(t, s3DefaultRobots, robots.body)
+
+	// Documents are not mappings, and are only uploaded if changed
+	pulled, err := db.Pull()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"INDEX":  "https://example.com/",
+		"a":      "https://example.com/a",
+		"secret": "https://internal.example.com/",
+	}, pulled, "pull ignores documents")
+	puts := fake.requests["put"]
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, puts, fake.requests["put"], "repeat push makes no puts")
+
+	// Directory index, and custom error and robots documents
+	errorPage := filepath.Join(db.Root, "404.html")
+	robotsFile := filepath.Join(db.Root, "robots.txt")
+	err = ioutil.WriteFile(errorPage, []byte("<h1>Gone fishing</h1>\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(robotsFile, []byte("User-agent: *\nDisallow: /\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure("  s3_index: directory\n  s3_error_document: " + errorPage + "\n  s3_robots: " + robotsFile + "\n")
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, puts+3, fake.requests["put"], "changed documents uploaded")
+	index = fake.object(db.Domain, "index.html")
+	assert.Equal(t, "", index.redirect, "directory index is not a redirect")
+	assert.Contains(t, index.body, "https://example.me/a")
+	assert.Contains(t, index.body, "Example A")
+	assert.NotContains(t, index.body, "internal.example.com", "directory excludes private entries")
+	assert.Equal(t, "<h1>Gone fishing</h1>\n", fake.object(db.Domain, "404.html").body)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", fake.object(db.Domain, "robots.txt").body)
+
+	// Unwanted documents are deleted, but objects not published by
+	// usher are never overwritten
+	configure("  s3_index: none\n")
+	err = db.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"404.html", "INDEX", "a", "robots.txt", "secret"}, fake.keys(db.Domain))
+	fake.put(db.Domain, "index.html", "https://example.com/manual", false)
+	configure("")
+	err = db.Push()
+	var pushErrs PushErrors
+	if assert.True(t, errors.As(err, &pushErrs), "push over unmanaged document") {
+		assert.Equal(t, "index.html", pushErrs[0].Code)
+	}
+	assert.Equal(t, "https://example.com/manual", fake.object(db.Domain, "index.html").redirect)
+
+	// Codes can't clash with documents, and options are checked
+	_, err = db.Add("https://example.com/robots", "robots.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Plan()
+	assert.Error(t, err, "code clashing with document")
+	err = db.writeConfigString(strings.Replace(string(config), "s3_documents: true", "s3_documents: false", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Plan()
+	assert.NoError(t, err, "code clash without documents")
+	configure("  s3_index: sitemap\n")
+	assert.Error(t, db.Push(), "invalid s3_index")
+	configure("  s3_error_document: " + filepath.Join(db.Root, "missing.html") + "\n")
+	assert.Error(t, db.Push(), "missing s3_error_document")
+}